@@ -0,0 +1,275 @@
+package tkbucket
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// LimitAlgorithm computes the limit of an AdaptiveLimiter from the outcome
+// of the requests. The AdaptiveLimiter serializes the calls.
+type LimitAlgorithm interface {
+	// Limit returns the current limit.
+	Limit() int64
+	// Update adjusts the limit from a request which took latency while
+	// inFlight requests were in flight, failed if it was dropped or timed
+	// out, and returns the new limit.
+	Update(latency time.Duration, inFlight int64, failed bool) int64
+}
+
+// AIMD is a LimitAlgorithm increasing the limit by one after each success,
+// and multiplying it by Backoff after each failure: additive increase,
+// multiplicative decrease.
+type AIMD struct {
+	// MinLimit and MaxLimit bound the limit.
+	MinLimit int64
+	MaxLimit int64
+	// Backoff holds the factor applied to the limit after a failure,
+	// NewAIMD sets it to 0.9.
+	Backoff float64
+	// Timeout, if not 0, makes the requests slower than it failures.
+	Timeout time.Duration
+	limit   int64
+}
+
+// NewAIMD creates an AIMD starting with the limit initial.
+func NewAIMD(initial, min, max int64) *AIMD {
+	checkAdaptive(initial, min, max)
+	return &AIMD{
+		MinLimit: min,
+		MaxLimit: max,
+		Backoff:  0.9,
+		limit:    initial,
+	}
+}
+
+func (a *AIMD) Limit() int64 {
+	return a.limit
+}
+
+func (a *AIMD) Update(latency time.Duration, inFlight int64, failed bool) int64 {
+	if failed || (a.Timeout > 0 && latency > a.Timeout) {
+		a.limit = int64(float64(a.limit) * a.Backoff)
+		if a.limit < a.MinLimit {
+			a.limit = a.MinLimit
+		}
+	} else if inFlight*2 >= a.limit && a.limit < a.MaxLimit {
+		// Only grow a limit which is used, or it grows forever
+		// when the load is low.
+		a.limit++
+	}
+	return a.limit
+}
+
+// Vegas is a LimitAlgorithm inspired by TCP Vegas. It estimates the queue
+// of the service from the latency compared to the lowest latency seen: the
+// limit grows while the queue is short, and shrinks when it is long or a
+// request fails.
+//
+// The lowest latency is never forgotten, the latency of a service which is
+// durably slower, e.g. after a deploy, is seen as a long queue. A new Vegas
+// should be used then.
+type Vegas struct {
+	// MinLimit and MaxLimit bound the limit.
+	MinLimit int64
+	MaxLimit int64
+	limit    float64
+	// noLoad holds the lowest latency seen.
+	noLoad time.Duration
+}
+
+// NewVegas creates a Vegas starting with the limit initial.
+func NewVegas(initial, min, max int64) *Vegas {
+	checkAdaptive(initial, min, max)
+	return &Vegas{
+		MinLimit: min,
+		MaxLimit: max,
+		limit:    float64(initial),
+	}
+}
+
+func (v *Vegas) Limit() int64 {
+	return int64(v.limit)
+}
+
+func (v *Vegas) Update(latency time.Duration, inFlight int64, failed bool) int64 {
+	if latency <= 0 {
+		return v.Limit()
+	}
+
+	// The thresholds grow with the log of the limit.
+	step := math.Max(1, math.Log10(v.limit))
+	switch {
+	case failed:
+		v.limit -= step
+	case v.noLoad == 0 || latency < v.noLoad:
+		v.noLoad = latency
+		return v.Limit()
+	case float64(inFlight)*2 < v.limit:
+		// The limit is not used, the latency says nothing about it.
+		return v.Limit()
+	default:
+		queue := v.limit * (1 - float64(v.noLoad)/float64(latency))
+		switch {
+		case queue <= step:
+			v.limit += 6 * step
+		case queue < 3*step:
+			v.limit += step
+		case queue > 6*step:
+			v.limit -= step
+		}
+	}
+
+	v.limit = math.Max(float64(v.MinLimit), math.Min(float64(v.MaxLimit), v.limit))
+	return v.Limit()
+}
+
+// AdaptiveLimiter is a ConcurrencyLimiter of the local process whose limit
+// is adjusted by a LimitAlgorithm from the outcome of the requests, reported
+// with Record. If it wraps a Bucket, the requests also take a token from it
+// once they have a permit.
+type AdaptiveLimiter struct {
+	algorithm LimitAlgorithm
+	bucket    Bucket
+	// mu guards the fields below it.
+	mu       sync.Mutex
+	limit    int64
+	inFlight int64
+	// changed is closed when a permit may be free, then replaced.
+	changed chan struct{}
+}
+
+// NewAdaptiveLimiter creates an AdaptiveLimiter driven by algorithm,
+// bucket may be nil.
+func NewAdaptiveLimiter(algorithm LimitAlgorithm, bucket Bucket) *AdaptiveLimiter {
+	return &AdaptiveLimiter{
+		algorithm: algorithm,
+		bucket:    bucket,
+		limit:     algorithm.Limit(),
+		changed:   make(chan struct{}),
+	}
+}
+
+// Acquire waits for a permit, then for a token of the bucket,
+// until ctx is done.
+func (l *AdaptiveLimiter) Acquire(ctx context.Context) (func(), error) {
+	for {
+		l.mu.Lock()
+		if l.inFlight < l.limit {
+			l.inFlight++
+			l.mu.Unlock()
+			break
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	release := l.release()
+	if l.bucket != nil {
+		if err := l.bucket.WaitContext(ctx, 1); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
+
+// TryAcquire takes a permit if one is free, or returns ErrNoPermit. It
+// returns ErrWaitTooLong if the bucket has no token available.
+func (l *AdaptiveLimiter) TryAcquire() (func(), error) {
+	l.mu.Lock()
+	if l.inFlight >= l.limit {
+		l.mu.Unlock()
+		return nil, ErrNoPermit
+	}
+	l.inFlight++
+	l.mu.Unlock()
+
+	release := l.release()
+	if l.bucket != nil {
+		if _, err := l.bucket.tryAcquireE(time.Now(), 1, 0); err != nil {
+			release()
+			return nil, err
+		}
+	}
+	return release, nil
+}
+
+// Record reports the outcome of a request to the LimitAlgorithm, any
+// err is a failure. It should be called before the permit is released.
+func (l *AdaptiveLimiter) Record(latency time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := l.algorithm.Update(latency, l.inFlight, err != nil)
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > l.limit {
+		l.notify()
+	}
+	l.limit = limit
+}
+
+// Do runs fn with a permit and records its outcome.
+func (l *AdaptiveLimiter) Do(ctx context.Context, fn func() error) error {
+	release, err := l.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	start := time.Now()
+	err = fn()
+	l.Record(time.Since(start), err)
+	return err
+}
+
+// InFlight returns the number of permits held.
+func (l *AdaptiveLimiter) InFlight() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight
+}
+
+// Limit returns the current number of permits.
+func (l *AdaptiveLimiter) Limit() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// release returns the function releasing a permit once.
+func (l *AdaptiveLimiter) release() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			l.inFlight--
+			l.notify()
+			l.mu.Unlock()
+		})
+	}
+}
+
+// notify wakes up the waiters, l.mu must be held.
+func (l *AdaptiveLimiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func checkAdaptive(initial, min, max int64) {
+	if min <= 0 {
+		panic("adaptive min limit is not > 0")
+	}
+	if initial < min || initial > max {
+		panic("adaptive initial limit is not within min and max")
+	}
+}
@@ -0,0 +1,124 @@
+package tkbucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type updateTest struct {
+	about    string
+	latency  time.Duration
+	inFlight int64
+	failed   bool
+	limit    int64
+}
+
+//------------------------------------Adaptive Test------------------------------------------
+func TestAIMD(t *testing.T) {
+	asserts := assert.New(t)
+
+	a := NewAIMD(10, 2, 12)
+	a.Timeout = time.Second
+	for _, test := range []updateTest{
+		{"success", 10 * time.Millisecond, 5, false, 11},
+		{"unused limit", 10 * time.Millisecond, 5, false, 11},
+		{"success", 10 * time.Millisecond, 11, false, 12},
+		{"max limit", 10 * time.Millisecond, 12, false, 12},
+		{"failure", 10 * time.Millisecond, 12, true, 10},
+		{"timeout", 2 * time.Second, 10, false, 9},
+		{"failure", 10 * time.Millisecond, 9, true, 8},
+		{"failure", 10 * time.Millisecond, 8, true, 7},
+	} {
+		asserts.Equal(test.limit, a.Update(test.latency, test.inFlight, test.failed), test.about)
+	}
+	for i := 0; i < 20; i++ {
+		a.Update(0, 0, true)
+	}
+	asserts.Equal(int64(2), a.Limit(), "min limit")
+	fmt.Println("AIMDTest: -> success")
+}
+
+func TestVegas(t *testing.T) {
+	asserts := assert.New(t)
+
+	v := NewVegas(10, 2, 100)
+	for _, test := range []updateTest{
+		{"no load latency", 100 * time.Millisecond, 10, false, 10},
+		{"unused limit", 100 * time.Millisecond, 4, false, 10},
+		{"no queue", 105 * time.Millisecond, 10, false, 16},
+		{"short queue", 125 * time.Millisecond, 16, false, 17},
+		{"queue", 150 * time.Millisecond, 17, false, 17},
+		{"long queue", 400 * time.Millisecond, 17, false, 15},
+		{"failure", 100 * time.Millisecond, 15, true, 14},
+		{"lower no load latency", 50 * time.Millisecond, 14, false, 14},
+		{"long queue", 100 * time.Millisecond, 14, false, 13},
+	} {
+		asserts.Equal(test.limit, v.Update(test.latency, test.inFlight, test.failed), test.about)
+	}
+	for i := 0; i < 20; i++ {
+		v.Update(time.Millisecond, 0, true)
+	}
+	asserts.Equal(int64(2), v.Limit(), "min limit")
+	fmt.Println("VegasTest: -> success")
+}
+
+func TestAdaptiveLimiter(t *testing.T) {
+	asserts := assert.New(t)
+
+	l := NewAdaptiveLimiter(NewAIMD(2, 1, 10), nil)
+	release1, err := l.Acquire(context.Background())
+	asserts.Nil(err)
+	release2, err := l.TryAcquire()
+	asserts.Nil(err)
+	_, err = l.TryAcquire()
+	asserts.Equal(ErrNoPermit, err)
+
+	// A success raises the limit and lets a waiting request in.
+	done := make(chan error)
+	go func() {
+		_, err := l.Acquire(context.Background())
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.Record(10*time.Millisecond, nil)
+	asserts.Nil(<-done)
+	asserts.Equal(int64(3), l.Limit())
+	asserts.Equal(int64(3), l.InFlight())
+
+	// A failure lowers the limit below the permits held.
+	l.Record(10*time.Millisecond, errors.New("overloaded"))
+	asserts.Equal(int64(2), l.Limit())
+	release1()
+	release1()
+	_, err = l.TryAcquire()
+	asserts.Equal(ErrNoPermit, err, "3 permits are held over a limit of 2")
+	release2()
+	asserts.Nil(l.Do(context.Background(), func() error { return nil }))
+	asserts.Equal(int64(1), l.InFlight())
+	fmt.Println("AdaptiveLimiterTest: -> success")
+}
+
+func TestAdaptiveLimiterBucket(t *testing.T) {
+	asserts := assert.New(t)
+
+	b, _ := NewMemoryStorage().Create("msf_adaptive", time.Hour, 1)
+	l := NewAdaptiveLimiter(NewVegas(5, 1, 10), b)
+	release, err := l.TryAcquire()
+	asserts.Nil(err)
+	release()
+
+	// The bucket is empty, the permit is given back.
+	_, err = l.TryAcquire()
+	asserts.Equal(ErrWaitTooLong, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.Acquire(ctx)
+	asserts.Equal(ErrWaitTooLong, err)
+	asserts.Equal(int64(0), l.InFlight())
+	fmt.Println("AdaptiveLimiterBucketTest: -> success")
+}
@@ -0,0 +1,267 @@
+package tkbucket
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// atomicBucket is a lock-free memoryBucket. Instead of avail and
+// latestTick, it holds a single base so that the number of available
+// tokens at any tick is
+//
+//	avail = min(capacity, tick*quantum - base)
+//
+// which is updated with a CAS loop. The tokens added by the ticks are
+// implied by the time, so reading the bucket never writes it.
+type atomicBucket struct {
+	// base is first to be 64-bit aligned, it is accessed atomically.
+	base int64
+	// startTime holds the moment when the bucket was
+	// first created and ticks began.
+	startTime time.Time
+	// capacity holds the overall capacity of the bucket.
+	capacity int64
+	// quantum holds how many tokens are added on each tick.
+	quantum int64
+	// fillInterval holds the interval between each tick.
+	fillInterval time.Duration
+	accessTime
+}
+
+func (b *atomicBucket) StartTime() time.Time {
+	return b.startTime
+}
+
+func (b *atomicBucket) Capacity() int64 {
+	return b.capacity
+}
+
+// Acquire takes up to count immediately available tokens from the bucket
+// result > 0，sufficient token
+func (b *atomicBucket) Acquire(count int64) int64 {
+	return b.acquire(time.Now(), count)
+}
+
+// TryAcquire try to acquire the token from the bucket
+func (b *atomicBucket) TryAcquire(count int64) time.Duration {
+	d, _ := b.tryAcquire(time.Now(), count, infinityDuration)
+	return d
+}
+
+// Wait try to acquire the token from the bucket and wait util to get it
+func (b *atomicBucket) Wait(count int64) {
+	if d := b.TryAcquire(count); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// WaitContext try to acquire the token from the bucket and wait util to get it,
+// or until ctx is done.
+func (b *atomicBucket) WaitContext(ctx context.Context, count int64) error {
+	return waitContext(ctx, b, count)
+}
+
+// WaitMaxDuration try to acquire the token from the bucket and wait util to get it,
+// if it needs to wait for no greater than maxWait.
+func (b *atomicBucket) WaitMaxDuration(count int64, maxWait time.Duration) bool {
+	return waitMaxDuration(b, count, maxWait)
+}
+
+// Reserve books count tokens from the bucket, see Reservation.
+func (b *atomicBucket) Reserve(count int64) *Reservation {
+	return reserve(b, time.Now(), count, infinityDuration)
+}
+
+// Available returns the number of available tokens.
+func (b *atomicBucket) Available() int64 {
+	return b.available(time.Now())
+}
+
+// AcquireE is like Acquire, the atomicBucket never fails.
+func (b *atomicBucket) AcquireE(count int64) (int64, error) {
+	return b.acquireE(time.Now(), count)
+}
+
+// TryAcquireE is like TryAcquire, the atomicBucket never fails.
+func (b *atomicBucket) TryAcquireE(count int64) (time.Duration, error) {
+	return b.tryAcquireE(time.Now(), count, infinityDuration)
+}
+
+// AvailableE is like Available, the atomicBucket never fails.
+func (b *atomicBucket) AvailableE() (int64, error) {
+	return b.availableE(time.Now())
+}
+
+// Allow takes count tokens if they are all available, see Decision.
+func (b *atomicBucket) Allow(count int64) Decision {
+	return b.allow(time.Now(), count)
+}
+
+// AllowE is like Allow, the atomicBucket never fails.
+func (b *atomicBucket) AllowE(count int64) (Decision, error) {
+	return b.allowE(time.Now(), count)
+}
+
+// acquire is the internal version of Acquire - it takes the
+// current time as an argument to enable easy testing.
+func (b *atomicBucket) acquire(now time.Time, count int64) int64 {
+	b.touch(now)
+	if count <= 0 {
+		return 0
+	}
+
+	tick := b.currentTick(now)
+	for {
+		base := atomic.LoadInt64(&b.base)
+		avail := b.avail(tick, base)
+		if avail <= 0 {
+			return 0
+		}
+		n := count
+		if n > avail {
+			n = avail
+		}
+		if atomic.CompareAndSwapInt64(&b.base, base, b.baseOf(tick, avail-n)) {
+			return n
+		}
+	}
+}
+
+// tryAcquire is the internal version of TryAcquire - it takes the current time as
+// an argument to enable easy testing.
+func (b *atomicBucket) tryAcquire(now time.Time, count int64, maxWait time.Duration) (time.Duration, bool) {
+	b.touch(now)
+	if count <= 0 {
+		return 0, true
+	}
+
+	tick := b.currentTick(now)
+	for {
+		base := atomic.LoadInt64(&b.base)
+		avail := b.avail(tick, base) - count
+		waitTime := time.Duration(0)
+		if avail < 0 {
+			waitTime = b.waitTime(now, tick, -avail)
+			if waitTime > maxWait {
+				return 0, false
+			}
+		}
+		if atomic.CompareAndSwapInt64(&b.base, base, b.baseOf(tick, avail)) {
+			return waitTime, true
+		}
+	}
+}
+
+// available is the internal version of Available - it takes the current time as
+// an argument to enable easy testing.
+func (b *atomicBucket) available(now time.Time) int64 {
+	return b.avail(b.currentTick(now), atomic.LoadInt64(&b.base))
+}
+
+// allow is the internal version of Allow - it takes the current time as
+// an argument to enable easy testing.
+func (b *atomicBucket) allow(now time.Time, count int64) Decision {
+	b.touch(now)
+	tick := b.currentTick(now)
+	wait := func(missing int64) time.Duration {
+		return b.waitTime(now, tick, missing)
+	}
+	for {
+		base := atomic.LoadInt64(&b.base)
+		d, avail := decide(count, b.avail(tick, base), b.capacity, wait)
+		if d.Granted == 0 || atomic.CompareAndSwapInt64(&b.base, base, b.baseOf(tick, avail)) {
+			return d
+		}
+	}
+}
+
+func (b *atomicBucket) acquireE(now time.Time, count int64) (int64, error) {
+	return b.acquire(now, count), nil
+}
+
+func (b *atomicBucket) tryAcquireE(now time.Time, count int64, maxWait time.Duration) (time.Duration, error) {
+	d, ok := b.tryAcquire(now, count, maxWait)
+	if !ok {
+		return 0, ErrWaitTooLong
+	}
+	return d, nil
+}
+
+func (b *atomicBucket) availableE(now time.Time) (int64, error) {
+	return b.available(now), nil
+}
+
+func (b *atomicBucket) allowE(now time.Time, count int64) (Decision, error) {
+	return b.allow(now, count), nil
+}
+
+// refund returns count tokens that were reserved by tryAcquire but not
+// consumed yet to the bucket.
+func (b *atomicBucket) refund(now, at time.Time, count int64) error {
+	b.touch(now)
+	if count <= 0 {
+		return nil
+	}
+
+	tick := b.currentTick(now)
+	for {
+		base := atomic.LoadInt64(&b.base)
+		avail := b.avail(tick, base) + count
+		if avail > b.capacity {
+			avail = b.capacity
+		}
+		if atomic.CompareAndSwapInt64(&b.base, base, b.baseOf(tick, avail)) {
+			return nil
+		}
+	}
+}
+
+// currentTick returns the current time tick, measured
+// from b.startTime.
+func (b *atomicBucket) currentTick(now time.Time) int64 {
+	return int64(now.Sub(b.startTime) / b.fillInterval)
+}
+
+// waitTime returns how long to wait from now, at tick, until
+// missing more tokens are available.
+func (b *atomicBucket) waitTime(now time.Time, tick, missing int64) time.Duration {
+	// endTick holds the tick when all the requested tokens will
+	// become available.
+	endTick := tick + (missing+b.quantum-1)/b.quantum
+	endTime := b.startTime.Add(time.Duration(endTick) * b.fillInterval)
+	return endTime.Sub(now)
+}
+
+// avail returns the number of available tokens at tick for base.
+func (b *atomicBucket) avail(tick, base int64) int64 {
+	avail := tick*b.quantum - base
+	if avail > b.capacity {
+		avail = b.capacity
+	}
+	return avail
+}
+
+// baseOf returns the base for avail tokens available at tick.
+func (b *atomicBucket) baseOf(tick, avail int64) int64 {
+	return tick*b.quantum - avail
+}
+
+func createAtomic(name string, fillInterval time.Duration, capacity, quantum int64) *atomicBucket {
+	if fillInterval <= 0 {
+		panic("token bucket fill interval is not > 0")
+	}
+	if capacity <= 0 {
+		panic("token bucket capacity is not > 0")
+	}
+	if quantum <= 0 {
+		panic("token bucket quantum is not > 0")
+	}
+	return &atomicBucket{
+		base:         -capacity,
+		startTime:    time.Now(),
+		fillInterval: fillInterval,
+		capacity:     capacity,
+		quantum:      quantum,
+	}
+}
@@ -0,0 +1,145 @@
+package tkbucket
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newLockFreeStorage() *MemoryStorage {
+	return NewMemoryStorageWithOptions(MemoryOptions{LockFree: true})
+}
+
+//------------------------------------Acquire Test------------------------------------------
+func TestAtomicAcquire(t *testing.T) {
+	asserts := assert.New(t)
+
+	for i, test := range acquire1Tests {
+		tb, err := newLockFreeStorage().CreateWithQuantum(fmt.Sprintf("msf_token_bucket_:%d", i), test.fillInterval, test.capacity, test.quantum)
+		asserts.Nil(err, "Token bucket create failed")
+		asserts.IsType(&atomicBucket{}, tb)
+
+		for j, req := range test.reqs {
+			d := tb.acquire(tb.StartTime().Add(req.time), req.count)
+			asserts.Equal(d, req.expect, fmt.Sprintf("test %d.%d, %s, got %v want %v", i, j, test.about, d, req.expect))
+		}
+		fmt.Println("AtomicAcquire1Tests:", test.about, "-> success")
+	}
+
+	for i, test := range acquire2Tests {
+		tb, err := newLockFreeStorage().Create(fmt.Sprintf("msf_token_bucket_:%d", i), test.fillInterval, test.capacity)
+		asserts.Nil(err, "Token bucket create failed")
+
+		c := tb.acquire(tb.StartTime(), test.take)
+		asserts.Equal(c, test.take, fmt.Sprintf("#%d: %s, take = %d, want = %d", i, test.about, c, test.take))
+		c = tb.available(tb.StartTime())
+		asserts.Equal(c, test.expectCountAfterTake, fmt.Sprintf("#%d: %s, after take, available = %d, want = %d", i, test.about, c, test.expectCountAfterTake))
+		c = tb.available(tb.StartTime().Add(test.sleep))
+		asserts.Equal(c, test.expectCountAfterSleep, fmt.Sprintf("#%d: %s, after some time it should fill in new tokens, available = %d, want = %d",
+			i, test.about, c, test.expectCountAfterSleep))
+		fmt.Println("AtomicAcquire2Tests:", test.about, "-> success")
+	}
+}
+
+//------------------------------------TryAcquire Test------------------------------------------
+func TestAtomicTryAcquire(t *testing.T) {
+	asserts := assert.New(t)
+
+	for i, test := range tryAcquireTests {
+		tb, err := newLockFreeStorage().Create(fmt.Sprintf("msf_token_bucket_:%d", i), test.fillInterval, test.capacity)
+		asserts.Nil(err, "Token bucket create failed")
+
+		for j, req := range test.reqs {
+			d, ok := tb.tryAcquire(tb.StartTime().Add(req.time), req.count, infinityDuration)
+			asserts.Equal(ok, true, fmt.Sprintf("unexpect: waitTime > maxWait(%v)", infinityDuration))
+			asserts.Equal(d, req.expectWait, fmt.Sprintf("test %d.%d, %s, got %v want %v", i, j, test.about, d, req.expectWait))
+		}
+		fmt.Println("AtomicTryAcquireTest:", test.about, "-> success")
+	}
+}
+
+func TestAtomicRefund(t *testing.T) {
+	asserts := assert.New(t)
+
+	tb, err := newLockFreeStorage().Create("msf_token_bucket", 250*time.Millisecond, 10)
+	asserts.Nil(err, "Token bucket create failed")
+
+	start := tb.StartTime()
+	tb.tryAcquire(start, 10, infinityDuration)
+	d, _ := tb.tryAcquire(start, 2, infinityDuration)
+	asserts.Equal(500*time.Millisecond, d)
+	_, ok := tb.tryAcquire(start, 1, 100*time.Millisecond)
+	asserts.False(ok, "the wait is too long")
+	tb.refund(start.Add(100*time.Millisecond), start.Add(100*time.Millisecond), 2)
+	asserts.Equal(int64(0), tb.available(start.Add(100*time.Millisecond)))
+	asserts.Equal(int64(1), tb.available(start.Add(250*time.Millisecond)))
+
+	// Refunds never overflow the capacity.
+	tb.refund(start.Add(time.Hour), start.Add(time.Hour), 5)
+	asserts.Equal(int64(10), tb.available(start.Add(time.Hour)))
+	fmt.Println("AtomicRefundTest: -> success")
+}
+
+func TestAtomicConcurrent(t *testing.T) {
+	asserts := assert.New(t)
+
+	tb, err := newLockFreeStorage().Create("msf_token_bucket", time.Hour, 1000)
+	asserts.Nil(err, "Token bucket create failed")
+
+	// No token is handed out twice, whatever the interleaving.
+	start := tb.StartTime()
+	const workers = 8
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		taken int64
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var n int64
+			for i := 0; i < 200; i++ {
+				n += tb.acquire(start, 1)
+			}
+			mu.Lock()
+			taken += n
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	asserts.Equal(int64(1000), taken)
+	asserts.Equal(int64(0), tb.available(start))
+	fmt.Println("AtomicConcurrentTest: -> success")
+}
+
+//------------------------------------Benchmark------------------------------------------
+// benchmarkContended takes the tokens of a single hot bucket from all the goroutines.
+func benchmarkContended(b *testing.B, nms *MemoryStorage) {
+	tb, _ := nms.Create("msf_token_bucket", 1, 1<<62)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			tb.Acquire(1)
+		}
+	})
+}
+
+func BenchmarkMemoryAcquireContended(b *testing.B) {
+	benchmarkContended(b, NewMemoryStorage())
+}
+
+func BenchmarkAtomicAcquireContended(b *testing.B) {
+	benchmarkContended(b, newLockFreeStorage())
+}
+
+func BenchmarkAtomicAcquire(b *testing.B) {
+	tb, _ := newLockFreeStorage().Create("msf_token_bucket", 1, 16*1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tb.Acquire(1)
+	}
+}
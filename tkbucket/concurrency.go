@@ -0,0 +1,302 @@
+package tkbucket
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	// defaultPermitTTL is the default RedisStorage.PermitTTL.
+	defaultPermitTTL = 10 * time.Second
+	// permitPollInterval is how often a redisConcurrency
+	// waiting for a permit looks for a free one.
+	permitPollInterval = 20 * time.Millisecond
+)
+
+// ConcurrencyLimiter bounds the number of requests in flight, e.g. to
+// protect a slow downstream service that a rate limit doesn't protect.
+type ConcurrencyLimiter interface {
+	// Acquire waits for a permit until ctx is done. The release function
+	// must be called when the request is done, it may be called more than once.
+	Acquire(ctx context.Context) (release func(), err error)
+	// TryAcquire takes a permit if one is free, or returns ErrNoPermit.
+	TryAcquire() (release func(), err error)
+	// InFlight returns the number of permits held, 0 if it could not be read.
+	InFlight() int64
+	// Limit returns the number of permits.
+	Limit() int64
+}
+
+// ConcurrencyStorage is implemented by the storages which create
+// concurrency limiters.
+type ConcurrencyStorage interface {
+	// CreateConcurrency creates a concurrency limiter of limit permits with a name.
+	CreateConcurrency(name string, limit int64) (ConcurrencyLimiter, error)
+}
+
+// memoryConcurrency is a ConcurrencyLimiter of the local process.
+type memoryConcurrency struct {
+	// permits holds a value per permit held.
+	permits chan struct{}
+	accessTime
+}
+
+func (c *memoryConcurrency) Acquire(ctx context.Context) (func(), error) {
+	c.touch(time.Now())
+	select {
+	case c.permits <- struct{}{}:
+		return c.release(), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *memoryConcurrency) TryAcquire() (func(), error) {
+	c.touch(time.Now())
+	select {
+	case c.permits <- struct{}{}:
+		return c.release(), nil
+	default:
+		return nil, ErrNoPermit
+	}
+}
+
+func (c *memoryConcurrency) InFlight() int64 {
+	return int64(len(c.permits))
+}
+
+func (c *memoryConcurrency) Limit() int64 {
+	return int64(cap(c.permits))
+}
+
+// release returns the function releasing a permit once.
+func (c *memoryConcurrency) release() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-c.permits })
+	}
+}
+
+// redisConcurrency is a ConcurrencyLimiter shared between processes. The
+// permits are members of a sorted set scored by the end of their lease, the
+// leases are renewed while the permits are held, so that the permits of a
+// crashed process are freed when their lease ends.
+type redisConcurrency struct {
+	Key     string
+	Client  redis.UniversalClient
+	storage *RedisStorage
+	limit   int64
+	// localOnce guards local, the fallback limiter of FailLocal.
+	localOnce sync.Once
+	local     *memoryConcurrency
+}
+
+// Acquire waits for a permit until ctx is done, looking for a free
+// one every permitPollInterval. The FailurePolicy of the RedisStorage
+// is applied.
+func (c *redisConcurrency) Acquire(ctx context.Context) (func(), error) {
+	for {
+		release, err := c.TryAcquire()
+		if err != ErrNoPermit {
+			return release, err
+		}
+
+		t := time.NewTimer(permitPollInterval)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// TryAcquire takes a permit if one is free, or returns ErrNoPermit.
+// The FailurePolicy of the RedisStorage is applied.
+func (c *redisConcurrency) TryAcquire() (func(), error) {
+	id, err := c.evalAcquire(time.Now())
+	if err == nil {
+		return c.hold(id), nil
+	}
+	if err == ErrNoPermit {
+		return nil, err
+	}
+	switch c.storage.fail(c.Key, err) {
+	case FailOpen:
+		return func() {}, nil
+	case FailLocal:
+		return c.localLimiter().TryAcquire()
+	}
+	return nil, err
+}
+
+// InFlight returns the number of permits held, 0 if Redis fails.
+func (c *redisConcurrency) InFlight() int64 {
+	// Execute lua script, EVALSHA falls back to EVAL on NOSCRIPT
+	res, err := scriptPermitInFlight.Run(
+		c.Client,
+		[]string{c.Key},
+		c.args(time.Now())...,
+	).Result()
+	if err != nil {
+		return 0
+	}
+	return res.(int64)
+}
+
+func (c *redisConcurrency) Limit() int64 {
+	return c.limit
+}
+
+// hold renews the lease of the permit id until it is released, and returns
+// the function releasing it once. A lost lease is reported to OnFailure.
+func (c *redisConcurrency) hold(id string) func() {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(c.storage.permitTTL() / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if ok, err := c.evalRenew(time.Now(), id); err == nil && !ok {
+					select {
+					case <-done:
+						// The permit has been released meanwhile.
+					default:
+						// The lease is lost, e.g. Redis has been flushed,
+						// another process may hold the permit.
+						c.storage.fail(c.Key, ErrPermitLost)
+					}
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			// The permit is freed when its lease ends anyway.
+			c.Client.ZRem(c.Key, id)
+		})
+	}
+}
+
+// localLimiter returns the fallback limiter of FailLocal.
+func (c *redisConcurrency) localLimiter() *memoryConcurrency {
+	c.localOnce.Do(func() {
+		c.local = &memoryConcurrency{permits: make(chan struct{}, c.limit)}
+	})
+	return c.local
+}
+
+// evalAcquire takes a permit and returns its id, or ErrNoPermit.
+func (c *redisConcurrency) evalAcquire(now time.Time) (string, error) {
+	id, err := newPermitID()
+	if err != nil {
+		return "", err
+	}
+
+	// Execute lua script, EVALSHA falls back to EVAL on NOSCRIPT
+	res, err := scriptPermitAcquire.Run(
+		c.Client,
+		[]string{c.Key},
+		c.args(now, c.limit, id)...,
+	).Result()
+	if err != nil {
+		return "", fmt.Errorf("%w: eval luaPermitAcquire: %v", ErrStorageUnavailable, err)
+	}
+	if res.(int64) == 0 {
+		return "", ErrNoPermit
+	}
+	return id, nil
+}
+
+// evalRenew extends the lease of the permit id,
+// it reports whether the permit is still held.
+func (c *redisConcurrency) evalRenew(now time.Time, id string) (bool, error) {
+	// Execute lua script, EVALSHA falls back to EVAL on NOSCRIPT
+	res, err := scriptPermitRenew.Run(
+		c.Client,
+		[]string{c.Key},
+		c.args(now, id)...,
+	).Result()
+	if err != nil {
+		return false, fmt.Errorf("%w: eval luaPermitRenew: %v", ErrStorageUnavailable, err)
+	}
+	return res.(int64) == 1, nil
+}
+
+// args returns the arguments of the lua scripts: the current time and
+// the permit TTL in milliseconds, followed by extra.
+func (c *redisConcurrency) args(now time.Time, extra ...interface{}) []interface{} {
+	args := []interface{}{
+		c.storage.timeArg(now.UnixNano() / int64(time.Millisecond)),
+		strconv.FormatInt(int64(c.storage.permitTTL()/time.Millisecond), 10),
+	}
+	return append(args, extra...)
+}
+
+// newPermitID returns a random id, unique between processes.
+func newPermitID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CreateConcurrency creates a memoryConcurrency. The limiters are evicted
+// like the buckets once no permit is in flight, see MemoryOptions, and the
+// existing limiter of name is returned whatever the limit.
+func (s *MemoryStorage) CreateConcurrency(name string, limit int64) (ConcurrencyLimiter, error) {
+	checkConcurrency(limit)
+	return s.get(time.Now(), memoryKey{concurrencyKind, name}, func() interface{} {
+		return &memoryConcurrency{permits: make(chan struct{}, limit)}
+	}).(*memoryConcurrency), nil
+}
+
+// CreateConcurrency creates a redisConcurrency, see RedisStorage.PermitTTL.
+// Nothing is stored until a permit is taken.
+func (r *RedisStorage) CreateConcurrency(key string, limit int64) (ConcurrencyLimiter, error) {
+	checkConcurrency(limit)
+	// The leases are stored in milliseconds.
+	if r.PermitTTL != 0 && r.PermitTTL < time.Millisecond {
+		panic("concurrency permit ttl is not 0 or >= 1ms")
+	}
+	return &redisConcurrency{
+		Key:     key,
+		Client:  r.Client,
+		storage: r,
+		limit:   limit,
+	}, nil
+}
+
+// CreateConcurrency creates a redisConcurrency, see RedisStorage.CreateConcurrency.
+func (s *HybridStorage) CreateConcurrency(key string, limit int64) (ConcurrencyLimiter, error) {
+	return s.Redis.CreateConcurrency(key, limit)
+}
+
+// permitTTL returns the lease of the permits of the concurrency limiters.
+func (r *RedisStorage) permitTTL() time.Duration {
+	if r.PermitTTL > 0 {
+		return r.PermitTTL
+	}
+	return defaultPermitTTL
+}
+
+func checkConcurrency(limit int64) {
+	if limit <= 0 {
+		panic("concurrency limit is not > 0")
+	}
+}
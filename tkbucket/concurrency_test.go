@@ -0,0 +1,133 @@
+package tkbucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//------------------------------------Concurrency Test------------------------------------------
+func TestConcurrencyAcquire(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, kind := range storageKinds {
+		c, err := newStorage(kind, TokenBucket).CreateConcurrency("msf_concurrency", 2)
+		asserts.Nil(err, "Concurrency create failed")
+		asserts.Equal(int64(2), c.Limit(), kind)
+
+		release1, err := c.Acquire(context.Background())
+		asserts.Nil(err, kind)
+		release2, err := c.TryAcquire()
+		asserts.Nil(err, kind)
+		asserts.Equal(int64(2), c.InFlight(), kind)
+		_, err = c.TryAcquire()
+		asserts.Equal(ErrNoPermit, err, kind)
+
+		// The waiting request gets the permit once it is released.
+		go func() {
+			time.Sleep(30 * time.Millisecond)
+			release1()
+		}()
+		release3, err := c.Acquire(context.Background())
+		asserts.Nil(err, kind)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+		_, err = c.Acquire(ctx)
+		cancel()
+		asserts.Equal(context.DeadlineExceeded, err, kind)
+
+		// A permit is released only once.
+		release1()
+		release2()
+		release2()
+		asserts.Equal(int64(1), c.InFlight(), kind)
+		release3()
+		asserts.Equal(int64(0), c.InFlight(), kind)
+		fmt.Println("ConcurrencyAcquireTest:", kind, "-> success")
+	}
+}
+
+func TestConcurrencyLease(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	nrs.Client.FlushDB()
+	nrs.PermitTTL = 300 * time.Millisecond
+	lost := make(chan error, 1)
+	nrs.OnFailure = func(key string, policy FailurePolicy, err error) {
+		select {
+		case lost <- err:
+		default:
+		}
+	}
+	cs, err := nrs.CreateConcurrency("msf_concurrency", 1)
+	asserts.Nil(err, "Concurrency create failed")
+	c := cs.(*redisConcurrency)
+
+	// The permit of a crashed holder is freed when its lease ends.
+	_, err = c.evalAcquire(time.Now().Add(-time.Second))
+	asserts.Nil(err)
+	asserts.Equal(int64(0), c.InFlight())
+	release, err := c.TryAcquire()
+	asserts.Nil(err, "the lease of the crashed holder has ended")
+
+	// The permit of a live holder is renewed.
+	time.Sleep(500 * time.Millisecond)
+	asserts.Equal(int64(1), c.InFlight())
+	_, err = c.TryAcquire()
+	asserts.Equal(ErrNoPermit, err)
+	release()
+	asserts.Equal(int64(0), c.InFlight())
+
+	// A released permit is not reported, a lost lease is.
+	select {
+	case err = <-lost:
+		asserts.Fail("a released permit is reported: " + err.Error())
+	default:
+	}
+	release, err = c.TryAcquire()
+	asserts.Nil(err)
+	nrs.Client.FlushDB()
+	select {
+	case err = <-lost:
+		asserts.Equal(ErrPermitLost, err)
+	case <-time.After(time.Second):
+		asserts.Fail("the lost lease is not reported")
+	}
+	release()
+
+	// The leases are stored in milliseconds.
+	nrs.PermitTTL = time.Microsecond
+	asserts.Panics(func() { nrs.CreateConcurrency("msf_concurrency", 1) })
+	fmt.Println("ConcurrencyLeaseTest: -> success")
+}
+
+func TestConcurrencyFailurePolicy(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(downClient, bucketExpire)
+	c, err := nrs.CreateConcurrency("msf_concurrency", 1)
+	asserts.Nil(err, "Concurrency create failed")
+
+	release, err := c.TryAcquire()
+	asserts.Nil(err, "fail-open")
+	release()
+
+	nrs.Policy = FailClosed
+	_, err = c.Acquire(context.Background())
+	asserts.True(errors.Is(err, ErrStorageUnavailable))
+
+	nrs.Policy = FailLocal
+	release, err = c.TryAcquire()
+	asserts.Nil(err)
+	_, err = c.TryAcquire()
+	asserts.Equal(ErrNoPermit, err)
+	release()
+	_, err = c.TryAcquire()
+	asserts.Nil(err)
+	fmt.Println("ConcurrencyFailurePolicyTest: -> success")
+}
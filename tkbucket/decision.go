@@ -0,0 +1,43 @@
+package tkbucket
+
+import "time"
+
+// Decision is the outcome of Allow, e.g. to fill the rate limit headers
+// of a response without reading the bucket again.
+type Decision struct {
+	// Allowed reports whether the tokens were taken.
+	Allowed bool
+	// Granted holds the number of tokens taken, the count if Allowed.
+	Granted int64
+	// Remaining holds the number of tokens left available.
+	Remaining int64
+	// Limit holds the capacity of the bucket.
+	Limit int64
+	// ResetAfter holds how long the bucket takes to be full again.
+	ResetAfter time.Duration
+	// RetryAfter holds how long to wait for the tokens if they are not
+	// Allowed. It is the longest time.Duration if they exceed the Limit.
+	RetryAfter time.Duration
+}
+
+// decide takes count tokens out of avail if they are all available, and
+// returns the Decision and the tokens left. wait returns how long missing
+// tokens take to arrive.
+func decide(count, avail, capacity int64, wait func(missing int64) time.Duration) (Decision, int64) {
+	d := Decision{Limit: capacity}
+	switch {
+	case count <= maxInt64(avail, 0):
+		d.Allowed, d.Granted = true, maxInt64(count, 0)
+		avail -= d.Granted
+	case count > capacity:
+		// The tokens never fit in the bucket.
+		d.RetryAfter = infinityDuration
+	default:
+		d.RetryAfter = wait(count - avail)
+	}
+	d.Remaining = maxInt64(avail, 0)
+	if avail < capacity {
+		d.ResetAfter = wait(capacity - avail)
+	}
+	return d, avail
+}
@@ -0,0 +1,97 @@
+package tkbucket
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var allowTests = []struct {
+	time   time.Duration
+	count  int64
+	expect Decision
+}{
+	{0, 2, Decision{Allowed: true, Granted: 2, Remaining: 1, Limit: 3, ResetAfter: 2 * time.Second}},
+	{0, 2, Decision{Remaining: 1, Limit: 3, ResetAfter: 2 * time.Second, RetryAfter: time.Second}},
+	{500 * time.Millisecond, 1, Decision{Allowed: true, Granted: 1, Limit: 3, ResetAfter: 2500 * time.Millisecond}},
+	{500 * time.Millisecond, 4, Decision{Limit: 3, ResetAfter: 2500 * time.Millisecond, RetryAfter: infinityDuration}},
+	{1500 * time.Millisecond, 1, Decision{Allowed: true, Granted: 1, Limit: 3, ResetAfter: 2500 * time.Millisecond}},
+	{1500 * time.Millisecond, 2, Decision{Limit: 3, ResetAfter: 2500 * time.Millisecond, RetryAfter: 1500 * time.Millisecond}},
+	{4 * time.Second, 0, Decision{Allowed: true, Remaining: 3, Limit: 3}},
+}
+
+//------------------------------------Allow Test------------------------------------------
+func TestAllow(t *testing.T) {
+	asserts := assert.New(t)
+
+	// The token buckets and GCRA agree for a fill interval of 1s, a quantum of 1 and a capacity of 3.
+	buckets := map[string]func() Bucket{
+		"memory": func() Bucket {
+			b, _ := newStorage("memory", TokenBucket).Create("msf_allow", time.Second, 3)
+			return b
+		},
+		"lock-free": func() Bucket {
+			b, _ := NewMemoryStorageWithOptions(MemoryOptions{LockFree: true}).Create("msf_allow", time.Second, 3)
+			return b
+		},
+		"continuous": func() Bucket {
+			b, _ := newStorage("memory", TokenBucket).CreateWithRate("msf_allow", 1, 3)
+			return b
+		},
+		"redis": func() Bucket {
+			b, _ := newStorage("redis", TokenBucket).Create("msf_allow", time.Second, 3)
+			return b
+		},
+		"redis continuous": func() Bucket {
+			b, _ := newStorage("redis", TokenBucket).CreateWithRate("msf_allow", 1, 3)
+			return b
+		},
+		"memory gcra": func() Bucket {
+			b, _ := newStorage("memory", GCRA).Create("msf_allow", time.Second, 3)
+			return b
+		},
+		"redis gcra": func() Bucket {
+			b, _ := newStorage("redis", GCRA).Create("msf_allow", time.Second, 3)
+			return b
+		},
+	}
+	for kind, newBucket := range buckets {
+		tb := newBucket()
+		for i, req := range allowTests {
+			d := tb.allow(tb.StartTime().Add(req.time), req.count)
+			asserts.Equal(req.expect, d, fmt.Sprintf("%s #%d", kind, i))
+		}
+		fmt.Println("AllowTest:", kind, "-> success")
+	}
+}
+
+func TestAllowFailure(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, policy := range []FailurePolicy{FailOpen, FailClosed, FailLocal} {
+		nrs := NewRedisStorage(downClient, bucketExpire)
+		tb, err := nrs.Create("msf_allow_failure", time.Second, 3)
+		asserts.Nil(err, "Token bucket create failed")
+		nrs.Policy = policy
+
+		d, err := tb.allowE(time.Now(), 2)
+		switch policy {
+		case FailOpen:
+			asserts.Nil(err)
+			asserts.Equal(Decision{Allowed: true, Granted: 2, Remaining: 3, Limit: 3}, d)
+		case FailClosed:
+			asserts.True(errors.Is(err, ErrStorageUnavailable))
+			asserts.False(d.Allowed)
+		case FailLocal:
+			asserts.Nil(err)
+			asserts.True(d.Allowed)
+			asserts.Equal(int64(1), d.Remaining)
+		}
+		_, err = tb.AllowE(2)
+		asserts.True(errors.Is(err, ErrStorageUnavailable))
+		fmt.Println("AllowFailureTest:", policy, "-> success")
+	}
+}
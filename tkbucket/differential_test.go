@@ -0,0 +1,107 @@
+package tkbucket
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// differentialOps holds the number of calls of each differential run.
+const differentialOps = 60
+
+// randomDelta returns a random time step for a bucket refilled every fillInterval.
+func randomDelta(r *rand.Rand, fillInterval time.Duration, capacity, quantum int64) time.Duration {
+	switch r.Intn(4) {
+	case 0:
+		return 0
+	case 1:
+		return time.Duration(r.Int63n(int64(fillInterval)))
+	case 2:
+		return time.Duration(r.Int63n(3*int64(fillInterval) + 1))
+	}
+	return time.Duration(r.Int63n((capacity/quantum + 2) * int64(fillInterval)))
+}
+
+//------------------------------------Differential Test------------------------------------------
+// TestDifferential drives a memory bucket and a Redis bucket with the same
+// random calls at the same times, and expects the same results.
+func TestDifferential(t *testing.T) {
+	asserts := assert.New(t)
+
+	seed := time.Now().UnixNano()
+	r := rand.New(rand.NewSource(seed))
+	for _, algorithm := range []Algorithm{TokenBucket, GCRA, SlidingWindowLog, SlidingWindowCounter} {
+		nrs := NewRedisStorage(redisClient, bucketExpire)
+		nrs.Client.FlushDB()
+		nrs.Algorithm = algorithm
+
+		for run := 0; run < 20; run++ {
+			// From a nanosecond to ten seconds.
+			fillInterval := time.Duration(1 + r.Int63n(int64(math.Pow10(r.Intn(11)))))
+			capacity := 1 + r.Int63n(100)
+			quantum := 1 + r.Int63n(capacity)
+			if algorithm == SlidingWindowLog {
+				// The log counts microseconds in Redis, the window is made of whole microseconds.
+				fillInterval = time.Duration(quantum) * (fillInterval/time.Microsecond + 1) * time.Microsecond
+			}
+			// Every other token bucket refills continuously.
+			continuous := algorithm == TokenBucket && run%2 == 1
+			var rate float64
+			if continuous {
+				rate = float64(quantum) / fillInterval.Seconds()
+				fillInterval, quantum = rateOf(rate)
+			}
+			about := fmt.Sprintf("seed %d, %s run %d, fill %v, capacity %d, quantum %d, continuous %v",
+				seed, algorithm, run, fillInterval, capacity, quantum, continuous)
+
+			name := fmt.Sprintf("msf_differential:%d", run)
+			var rb Bucket
+			var err error
+			if continuous {
+				rb, err = nrs.CreateWithRate(name, rate, capacity)
+			} else {
+				rb, err = nrs.CreateWithQuantum(name, fillInterval, capacity, quantum)
+			}
+			asserts.Nil(err, about)
+			now := rb.StartTime()
+			mb := createWithAlgorithm(algorithm, "msf_differential", fillInterval, capacity, quantum)
+			if continuous {
+				mb = createContinuous("msf_differential", fillInterval, capacity, quantum)
+			}
+			if b, ok := mb.(*memoryBucket); ok {
+				b.startTime = now
+			}
+
+			for i := 0; i < differentialOps; i++ {
+				delta := randomDelta(r, fillInterval, capacity, quantum)
+				if algorithm == SlidingWindowLog {
+					delta = delta.Truncate(time.Microsecond)
+				}
+				now = now.Add(delta)
+				count := 1 + r.Int63n(capacity+1)
+				op := fmt.Sprintf("%s, op %d at %v", about, i, now.Sub(rb.StartTime()))
+				switch r.Intn(5) {
+				case 0:
+					asserts.Equal(mb.acquire(now, count), rb.acquire(now, count), op+" acquire")
+				case 1:
+					maxWait := []time.Duration{0, time.Duration(r.Int63n(4 * int64(fillInterval))), infinityDuration}[r.Intn(3)]
+					md, mok := mb.tryAcquire(now, count, maxWait)
+					rd, rok := rb.tryAcquire(now, count, maxWait)
+					asserts.Equal(mok, rok, op+" tryAcquire")
+					asserts.Equal(md, rd, op+" tryAcquire wait")
+				case 2:
+					asserts.Equal(mb.available(now), rb.available(now), op+" available")
+				case 3:
+					asserts.Equal(mb.refund(now, now, count), rb.refund(now, now, count), op+" refund")
+				case 4:
+					asserts.Equal(mb.allow(now, count), rb.allow(now, count), op+" allow")
+				}
+			}
+		}
+		fmt.Println("DifferentialTest:", algorithm, "-> success")
+	}
+}
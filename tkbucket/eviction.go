@@ -0,0 +1,215 @@
+package tkbucket
+
+import (
+	"container/list"
+	"sync/atomic"
+	"time"
+)
+
+// MemoryStats holds the eviction statistics of a MemoryStorage.
+type MemoryStats struct {
+	// Buckets holds the number of buckets, quotas and
+	// concurrency limiters in the storage.
+	Buckets int64
+	// LRUEvictions holds the number of entries evicted
+	// because of MaxEntries.
+	LRUEvictions uint64
+	// IdleEvictions holds the number of idle entries
+	// evicted by the janitor.
+	IdleEvictions uint64
+}
+
+// memoryStats holds the counters of MemoryStats,
+// they are updated atomically.
+type memoryStats struct {
+	buckets       int64
+	lruEvictions  uint64
+	idleEvictions uint64
+}
+
+// Stats returns the eviction statistics of the storage.
+func (s *MemoryStorage) Stats() MemoryStats {
+	return MemoryStats{
+		Buckets:       atomic.LoadInt64(&s.stats.buckets),
+		LRUEvictions:  atomic.LoadUint64(&s.stats.lruEvictions),
+		IdleEvictions: atomic.LoadUint64(&s.stats.idleEvictions),
+	}
+}
+
+// Close stops the janitor of the storage. The entries are kept.
+func (s *MemoryStorage) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+// lruSamples holds the number of shards looked at to find
+// the least recently used entry.
+const lruSamples = 8
+
+// accessResolution holds the resolution of the access times recorded by
+// the buckets, so that a hot bucket doesn't write its entry on every call.
+const accessResolution = time.Millisecond
+
+// accessTracker is implemented by the values of a MemoryStorage.
+type accessTracker interface {
+	track(lastAccess *int64)
+}
+
+// accessTime records the uses of a bucket in the lastAccess of its
+// entry, so that a bucket kept by the caller is not evicted while used.
+type accessTime struct {
+	lastAccess *int64
+}
+
+// track records the uses of the bucket in lastAccess.
+func (a *accessTime) track(lastAccess *int64) {
+	a.lastAccess = lastAccess
+}
+
+// touch records a use of the bucket at now.
+func (a *accessTime) touch(now time.Time) {
+	if a.lastAccess == nil {
+		return
+	}
+	t := now.UnixNano()
+	if t-atomic.LoadInt64(a.lastAccess) >= int64(accessResolution) {
+		atomic.StoreInt64(a.lastAccess, t)
+	}
+}
+
+// evictLRU evicts the least recently used entry among the last entries
+// of the LRU lists of a few shards, starting with the shard of key.
+// The values used without Create since they were moved to the front
+// of their list are moved to the front again first.
+// The value of key itself, just created, is never evicted, nor are the
+// concurrency limiters with permits in flight.
+// The evicted entry is only approximately the least recently used
+// one of the storage, the same way Redis samples keys to evict.
+func (s *MemoryStorage) evictLRU(key memoryKey) {
+	start := shardIndex(key.name)
+	var (
+		victim  *memoryEntry
+		vShard  *memoryShard
+		samples int
+	)
+	for i := 0; i < memoryShards && samples < lruSamples; i++ {
+		shard := &s.shards[(start+i)&(memoryShards-1)]
+		shard.mu.Lock()
+		// Look at the ones before in the same shard if needed.
+		elem := shard.back()
+		for elem != nil {
+			e := elem.Value.(*memoryEntry)
+			if e.key != key && !held(e.value) {
+				break
+			}
+			elem = elem.Prev()
+		}
+		if elem != nil {
+			e := elem.Value.(*memoryEntry)
+			samples++
+			if victim == nil || atomic.LoadInt64(&e.lastAccess) < atomic.LoadInt64(&victim.lastAccess) {
+				victim, vShard = e, shard
+			}
+		}
+		shard.mu.Unlock()
+	}
+	if victim == nil {
+		return
+	}
+
+	vShard.mu.Lock()
+	// The entry may have been evicted while the lock was released.
+	if vShard.entries[victim.key] != victim {
+		vShard.mu.Unlock()
+		return
+	}
+	vShard.lru.Remove(victim.elem)
+	delete(vShard.entries, victim.key)
+	vShard.mu.Unlock()
+
+	atomic.AddInt64(&s.stats.buckets, -1)
+	atomic.AddUint64(&s.stats.lruEvictions, 1)
+}
+
+// back returns the last element of the LRU list of the shard, after moving
+// the values used since they were listed to the front, shard.mu must be held.
+func (shard *memoryShard) back() *list.Element {
+	elem := shard.lru.Back()
+	for n := shard.lru.Len(); n > 0 && elem != nil; n-- {
+		e := elem.Value.(*memoryEntry)
+		lastAccess := atomic.LoadInt64(&e.lastAccess)
+		if lastAccess <= e.listed {
+			break
+		}
+		e.listed = lastAccess
+		shard.lru.MoveToFront(elem)
+		elem = shard.lru.Back()
+	}
+	return elem
+}
+
+// janitor evicts the idle entries until the storage is closed.
+func (s *MemoryStorage) janitor() {
+	ticker := time.NewTicker(s.opts.JanitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.evictIdle(now)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// evictIdle evicts the entries which are unused for IdleTimeout
+// and idle at now.
+func (s *MemoryStorage) evictIdle(now time.Time) {
+	deadline := now.Add(-s.opts.IdleTimeout).UnixNano()
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.Lock()
+		for key, e := range shard.entries {
+			if atomic.LoadInt64(&e.lastAccess) > deadline {
+				continue
+			}
+			if !idle(e.value, now) {
+				continue
+			}
+			if e.elem != nil {
+				shard.lru.Remove(e.elem)
+			}
+			delete(shard.entries, key)
+			atomic.AddInt64(&s.stats.buckets, -1)
+			atomic.AddUint64(&s.stats.idleEvictions, 1)
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// idle reports whether value is identical at now to the fresh value
+// created on next use, so that evicting it loses nothing: a bucket
+// refilled to capacity, a quota unused in the current period or a
+// concurrency limiter without permits in flight.
+func idle(value interface{}, now time.Time) bool {
+	switch v := value.(type) {
+	case Bucket:
+		return v.available(now) >= v.Capacity()
+	case *memoryQuota:
+		return v.idle(now)
+	case *memoryConcurrency:
+		return v.InFlight() == 0
+	}
+	return false
+}
+
+// held reports whether value must not be evicted whatever its last use:
+// a concurrency limiter evicted with permits in flight would let more
+// requests in than its limit.
+func held(value interface{}) bool {
+	c, ok := value.(*memoryConcurrency)
+	return ok && c.InFlight() > 0
+}
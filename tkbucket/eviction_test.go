@@ -0,0 +1,189 @@
+package tkbucket
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryEvictLRU(t *testing.T) {
+	asserts := assert.New(t)
+
+	nms := NewMemoryStorageWithOptions(MemoryOptions{MaxEntries: 300})
+	defer nms.Close()
+
+	hot, err := nms.Create("msf_token_bucket_:hot", time.Second, 10)
+	asserts.Nil(err, "Token bucket create failed")
+	for i := 0; i < 1000; i++ {
+		nms.Create(fmt.Sprintf("msf_token_bucket_:%d", i), time.Second, 10)
+		// The hot bucket is used all along, it is never evicted.
+		tb, _ := nms.Create("msf_token_bucket_:hot", time.Second, 10)
+		asserts.True(tb == hot, fmt.Sprintf("hot bucket evicted at %d", i))
+	}
+
+	stats := nms.Stats()
+	asserts.Equal(int64(300), stats.Buckets)
+	asserts.Equal(uint64(701), stats.LRUEvictions)
+	asserts.Equal(uint64(0), stats.IdleEvictions)
+
+	// The last created buckets are still there.
+	n := 0
+	for i := 900; i < 1000; i++ {
+		shard := nms.shard(fmt.Sprintf("msf_token_bucket_:%d", i))
+		if _, ok := shard.entries[memoryKey{bucketKind, fmt.Sprintf("msf_token_bucket_:%d", i)}]; ok {
+			n++
+		}
+	}
+	asserts.True(n > 90, fmt.Sprintf("only %d recent buckets are kept", n))
+	fmt.Println("EvictLRUTest: -> success")
+}
+
+func TestMemoryEvictLRUKept(t *testing.T) {
+	asserts := assert.New(t)
+
+	nms := NewMemoryStorageWithOptions(MemoryOptions{MaxEntries: 300})
+	defer nms.Close()
+
+	kept, err := nms.Create("msf_token_bucket_:kept", time.Second, 10)
+	asserts.Nil(err, "Token bucket create failed")
+	now := time.Now()
+	for i := 0; i < 1000; i++ {
+		nms.Create(fmt.Sprintf("msf_token_bucket_:%d", i), time.Second, 10)
+		// The bucket is kept by the caller and used all along, it is never evicted.
+		kept.acquire(now.Add(time.Duration(i+1)*time.Millisecond), 1)
+	}
+	tb, _ := nms.Create("msf_token_bucket_:kept", time.Second, 10)
+	asserts.True(tb == kept, "kept bucket evicted")
+	asserts.Equal(uint64(701), nms.Stats().LRUEvictions)
+
+	// The idle buckets are evicted all the same.
+	idle, _ := nms.Create("msf_token_bucket_:idle", time.Second, 10)
+	idle.Acquire(1)
+	nms.evictIdle(time.Now().Add(time.Hour))
+	tb, _ = nms.Create("msf_token_bucket_:idle", time.Second, 10)
+	asserts.True(tb != idle, "idle bucket kept")
+	fmt.Println("EvictLRUKeptTest: -> success")
+}
+
+func TestMemoryEvictIdle(t *testing.T) {
+	asserts := assert.New(t)
+
+	nms := NewMemoryStorageWithOptions(MemoryOptions{IdleTimeout: time.Minute})
+	defer nms.Close()
+
+	full, _ := nms.Create("msf_token_bucket_:full", time.Second, 10)
+	used, _ := nms.Create("msf_token_bucket_:used", time.Hour, 10)
+	used.Acquire(1)
+	start := time.Now()
+
+	// Nothing is idle yet.
+	nms.evictIdle(start)
+	asserts.Equal(int64(2), nms.Stats().Buckets)
+
+	// The used bucket is idle but not refilled, it must be kept.
+	nms.evictIdle(start.Add(2 * time.Minute))
+	stats := nms.Stats()
+	asserts.Equal(int64(1), stats.Buckets)
+	asserts.Equal(uint64(1), stats.IdleEvictions)
+	tb, _ := nms.Create("msf_token_bucket_:used", time.Hour, 10)
+	asserts.True(tb == used, "not refilled bucket evicted")
+	tb, _ = nms.Create("msf_token_bucket_:full", time.Second, 10)
+	asserts.True(tb != full, "idle bucket kept")
+	fmt.Println("EvictIdleTest: -> success")
+}
+
+func TestMemoryEvictQuotaConcurrency(t *testing.T) {
+	asserts := assert.New(t)
+
+	nms := NewMemoryStorageWithOptions(MemoryOptions{IdleTimeout: time.Minute})
+	defer nms.Close()
+
+	// A bucket, a quota and a concurrency limiter may share a name.
+	nms.Create("msf_entry", time.Second, 10)
+	q, _ := nms.CreateQuota("msf_entry", Daily, 10, nil)
+	c, _ := nms.CreateConcurrency("msf_entry", 1)
+	unused, _ := nms.CreateQuota("msf_unused", Daily, 10, nil)
+	asserts.Equal(int64(4), nms.Stats().Buckets)
+
+	start := time.Now()
+	_, end := Daily.bounds(start, time.UTC)
+	q.acquireE(start, 1)
+	release, err := c.TryAcquire()
+	asserts.Nil(err)
+
+	// The quota used in its period and the limiter with a permit in flight are kept.
+	nms.evictIdle(start.Add(2 * time.Minute))
+	asserts.Equal(int64(2), nms.Stats().Buckets)
+	tq, _ := nms.CreateQuota("msf_entry", Daily, 10, nil)
+	asserts.True(tq == q, "used quota evicted")
+	tq, _ = nms.CreateQuota("msf_unused", Daily, 10, nil)
+	asserts.True(tq != unused, "unused quota kept")
+	tc, _ := nms.CreateConcurrency("msf_entry", 1)
+	asserts.True(tc == c, "held limiter evicted")
+
+	// Once its period has ended and no permit is in flight, they are evicted.
+	release()
+	nms.evictIdle(end.Add(2 * time.Minute))
+	tq, _ = nms.CreateQuota("msf_entry", Daily, 10, nil)
+	asserts.True(tq != q, "ended quota kept")
+	tc, _ = nms.CreateConcurrency("msf_entry", 1)
+	asserts.True(tc != c, "idle limiter kept")
+	fmt.Println("EvictQuotaConcurrencyTest: -> success")
+}
+
+func TestMemoryEvictLRUHeld(t *testing.T) {
+	asserts := assert.New(t)
+
+	nms := NewMemoryStorageWithOptions(MemoryOptions{MaxEntries: 10})
+	defer nms.Close()
+
+	c, _ := nms.CreateConcurrency("msf_concurrency", 1)
+	release, err := c.TryAcquire()
+	asserts.Nil(err)
+	for i := 0; i < 100; i++ {
+		nms.Create(fmt.Sprintf("msf_token_bucket_:%d", i), time.Second, 10)
+	}
+	// The limiter with a permit in flight is never evicted.
+	tc, _ := nms.CreateConcurrency("msf_concurrency", 1)
+	asserts.True(tc == c, "held limiter evicted")
+	_, err = tc.TryAcquire()
+	asserts.Equal(ErrNoPermit, err)
+	release()
+	fmt.Println("EvictLRUHeldTest: -> success")
+}
+
+func TestMemoryJanitor(t *testing.T) {
+	asserts := assert.New(t)
+
+	nms := NewMemoryStorageWithOptions(MemoryOptions{
+		IdleTimeout:     10 * time.Millisecond,
+		JanitorInterval: 5 * time.Millisecond,
+	})
+	nms.Create("msf_token_bucket", time.Millisecond, 10)
+	time.Sleep(100 * time.Millisecond)
+	asserts.Equal(int64(0), nms.Stats().Buckets)
+
+	asserts.Nil(nms.Close())
+	asserts.Nil(nms.Close(), "close twice")
+	fmt.Println("JanitorTest: -> success")
+}
+
+//------------------------------------Benchmark------------------------------------------
+func BenchmarkMemoryStorageCreateLRU(b *testing.B) {
+	keys := loadBenchKeys()
+	nms := NewMemoryStorageWithOptions(MemoryOptions{MaxEntries: benchKeyCount / 4})
+	defer nms.Close()
+	var worker uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// Every goroutine walks the keys from its own offset.
+		i := atomic.AddUint64(&worker, 1) << 16
+		for pb.Next() {
+			i++
+			nms.Create(keys[i&(benchKeyCount-1)], time.Second, 10)
+		}
+	})
+}
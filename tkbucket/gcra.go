@@ -0,0 +1,277 @@
+package tkbucket
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// gcraInterval returns the emission interval of a GCRA bucket,
+// the time it takes for one token to arrive. It is rounded down
+// to the nanosecond, but never 0.
+func gcraInterval(fillInterval time.Duration, quantum int64) time.Duration {
+	if interval := fillInterval / time.Duration(quantum); interval > 0 {
+		return interval
+	}
+	return 1
+}
+
+// gcraBucket is a memory bucket counting its tokens with GCRA.
+// The tat is a single word updated with a CAS loop, so it is lock-free.
+type gcraBucket struct {
+	// tat is first to be 64-bit aligned, it holds the theoretical arrival
+	// time in nanoseconds since startTime and is accessed atomically.
+	// The bucket is full when tat is not after now.
+	tat int64
+	// startTime holds the moment when the bucket was created.
+	startTime time.Time
+	// capacity holds the overall capacity of the bucket.
+	capacity int64
+	// interval holds the time it takes for one token to arrive.
+	interval int64
+	// tau holds the time it takes to refill the empty bucket.
+	tau int64
+	accessTime
+}
+
+func (b *gcraBucket) StartTime() time.Time {
+	return b.startTime
+}
+
+func (b *gcraBucket) Capacity() int64 {
+	return b.capacity
+}
+
+// Acquire takes up to count immediately available tokens from the bucket
+// result > 0，sufficient token
+func (b *gcraBucket) Acquire(count int64) int64 {
+	return b.acquire(time.Now(), count)
+}
+
+// TryAcquire try to acquire the token from the bucket
+func (b *gcraBucket) TryAcquire(count int64) time.Duration {
+	d, _ := b.tryAcquire(time.Now(), count, infinityDuration)
+	return d
+}
+
+// Wait try to acquire the token from the bucket and wait util to get it
+func (b *gcraBucket) Wait(count int64) {
+	if d := b.TryAcquire(count); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// WaitContext try to acquire the token from the bucket and wait util to get it,
+// or until ctx is done.
+func (b *gcraBucket) WaitContext(ctx context.Context, count int64) error {
+	return waitContext(ctx, b, count)
+}
+
+// WaitMaxDuration try to acquire the token from the bucket and wait util to get it,
+// if it needs to wait for no greater than maxWait.
+func (b *gcraBucket) WaitMaxDuration(count int64, maxWait time.Duration) bool {
+	return waitMaxDuration(b, count, maxWait)
+}
+
+// Reserve books count tokens from the bucket, see Reservation.
+func (b *gcraBucket) Reserve(count int64) *Reservation {
+	return reserve(b, time.Now(), count, infinityDuration)
+}
+
+// Available returns the number of available tokens.
+func (b *gcraBucket) Available() int64 {
+	return b.available(time.Now())
+}
+
+// AcquireE is like Acquire, the gcraBucket never fails.
+func (b *gcraBucket) AcquireE(count int64) (int64, error) {
+	return b.acquireE(time.Now(), count)
+}
+
+// TryAcquireE is like TryAcquire, the gcraBucket never fails.
+func (b *gcraBucket) TryAcquireE(count int64) (time.Duration, error) {
+	return b.tryAcquireE(time.Now(), count, infinityDuration)
+}
+
+// AvailableE is like Available, the gcraBucket never fails.
+func (b *gcraBucket) AvailableE() (int64, error) {
+	return b.availableE(time.Now())
+}
+
+// Allow takes count tokens if they are all available, see Decision.
+func (b *gcraBucket) Allow(count int64) Decision {
+	return b.allow(time.Now(), count)
+}
+
+// AllowE is like Allow, the gcraBucket never fails.
+func (b *gcraBucket) AllowE(count int64) (Decision, error) {
+	return b.allowE(time.Now(), count)
+}
+
+// acquire is the internal version of Acquire - it takes the
+// current time as an argument to enable easy testing.
+func (b *gcraBucket) acquire(now time.Time, count int64) int64 {
+	b.touch(now)
+	if count <= 0 {
+		return 0
+	}
+
+	t := b.since(now)
+	for {
+		old := atomic.LoadInt64(&b.tat)
+		tat := maxInt64(old, t)
+		avail := floorDiv(t+b.tau-tat, b.interval)
+		if avail <= 0 {
+			return 0
+		}
+		if count > avail {
+			count = avail
+		}
+		if atomic.CompareAndSwapInt64(&b.tat, old, tat+count*b.interval) {
+			return count
+		}
+	}
+}
+
+// tryAcquire is the internal version of TryAcquire - it takes the current time as
+// an argument to enable easy testing.
+func (b *gcraBucket) tryAcquire(now time.Time, count int64, maxWait time.Duration) (time.Duration, bool) {
+	b.touch(now)
+	if count <= 0 {
+		return 0, true
+	}
+
+	t := b.since(now)
+	for {
+		old := atomic.LoadInt64(&b.tat)
+		tat := maxInt64(old, t) + count*b.interval
+		// The request conforms once the new tat is within tau of the time.
+		waitTime := time.Duration(maxInt64(tat-b.tau-t, 0))
+		if waitTime > maxWait {
+			return 0, false
+		}
+		if atomic.CompareAndSwapInt64(&b.tat, old, tat) {
+			return waitTime, true
+		}
+	}
+}
+
+// available is the internal version of Available - it takes the current time as
+// an argument to enable easy testing.
+func (b *gcraBucket) available(now time.Time) int64 {
+	t := b.since(now)
+	tat := maxInt64(atomic.LoadInt64(&b.tat), t)
+	return floorDiv(t+b.tau-tat, b.interval)
+}
+
+// allow is the internal version of Allow - it takes the current time as
+// an argument to enable easy testing.
+func (b *gcraBucket) allow(now time.Time, count int64) Decision {
+	b.touch(now)
+	t := b.since(now)
+	for {
+		old := atomic.LoadInt64(&b.tat)
+		tat := maxInt64(old, t)
+		avail := floorDiv(t+b.tau-tat, b.interval)
+		d := Decision{Limit: b.capacity}
+		switch {
+		case count <= maxInt64(avail, 0):
+			d.Allowed, d.Granted = true, maxInt64(count, 0)
+			tat += d.Granted * b.interval
+			avail -= d.Granted
+		case count > b.capacity:
+			// The tokens never fit in the bucket.
+			d.RetryAfter = infinityDuration
+		default:
+			// The request conforms once the new tat is within tau of the time.
+			d.RetryAfter = time.Duration(tat + count*b.interval - b.tau - t)
+		}
+		d.Remaining = maxInt64(avail, 0)
+		d.ResetAfter = time.Duration(tat - t)
+		if d.Granted == 0 || atomic.CompareAndSwapInt64(&b.tat, old, tat) {
+			return d
+		}
+	}
+}
+
+func (b *gcraBucket) acquireE(now time.Time, count int64) (int64, error) {
+	return b.acquire(now, count), nil
+}
+
+func (b *gcraBucket) tryAcquireE(now time.Time, count int64, maxWait time.Duration) (time.Duration, error) {
+	d, ok := b.tryAcquire(now, count, maxWait)
+	if !ok {
+		return 0, ErrWaitTooLong
+	}
+	return d, nil
+}
+
+func (b *gcraBucket) availableE(now time.Time) (int64, error) {
+	return b.available(now), nil
+}
+
+func (b *gcraBucket) allowE(now time.Time, count int64) (Decision, error) {
+	return b.allow(now, count), nil
+}
+
+// refund returns count tokens that were reserved by tryAcquire but not
+// consumed yet to the bucket.
+func (b *gcraBucket) refund(now, at time.Time, count int64) error {
+	b.touch(now)
+	if count <= 0 {
+		return nil
+	}
+
+	t := b.since(now)
+	for {
+		old := atomic.LoadInt64(&b.tat)
+		// The tat never goes before the time, the bucket is full then.
+		tat := maxInt64(maxInt64(old, t)-count*b.interval, t)
+		if atomic.CompareAndSwapInt64(&b.tat, old, tat) {
+			return nil
+		}
+	}
+}
+
+// since returns the nanoseconds elapsed from b.startTime to now.
+func (b *gcraBucket) since(now time.Time) int64 {
+	return int64(now.Sub(b.startTime))
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// floorDiv returns a/b rounded down, b must be > 0.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b < 0 {
+		q--
+	}
+	return q
+}
+
+func createGCRA(name string, fillInterval time.Duration, capacity, quantum int64) *gcraBucket {
+	if fillInterval <= 0 {
+		panic("token bucket fill interval is not > 0")
+	}
+	if capacity <= 0 {
+		panic("token bucket capacity is not > 0")
+	}
+	if quantum <= 0 {
+		panic("token bucket quantum is not > 0")
+	}
+	interval := int64(gcraInterval(fillInterval, quantum))
+	return &gcraBucket{
+		// The bucket is full, even before startTime.
+		tat:       math.MinInt64,
+		startTime: time.Now(),
+		capacity:  capacity,
+		interval:  interval,
+		tau:       capacity * interval,
+	}
+}
@@ -0,0 +1,136 @@
+package tkbucket
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//------------------------------------Acquire Test------------------------------------------
+func TestGCRAAcquire(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, kind := range storageKinds {
+		s := newStorage(kind, GCRA)
+		for i, test := range acquire1Tests {
+			tb, err := s.CreateWithQuantum(fmt.Sprintf("msf_gcra_bucket_:%d", i), test.fillInterval, test.capacity, test.quantum)
+			asserts.Nil(err, "Token bucket create failed")
+
+			for j, req := range test.reqs {
+				d := tb.acquire(tb.StartTime().Add(req.time), req.count)
+				asserts.Equal(d, req.expect, fmt.Sprintf("%s test %d.%d, %s, got %v want %v", kind, i, j, test.about, d, req.expect))
+			}
+			fmt.Println("GCRAAcquire1Tests:", kind, test.about, "-> success")
+		}
+
+		s = newStorage(kind, GCRA)
+		for i, test := range acquire2Tests {
+			tb, err := s.Create(fmt.Sprintf("msf_gcra_bucket_:%d", i), test.fillInterval, test.capacity)
+			asserts.Nil(err, "Token bucket create failed")
+
+			c := tb.acquire(tb.StartTime(), test.take)
+			asserts.Equal(c, test.take, fmt.Sprintf("%s #%d: %s, take = %d, want = %d", kind, i, test.about, c, test.take))
+			c = tb.available(tb.StartTime())
+			asserts.Equal(c, test.expectCountAfterTake, fmt.Sprintf("%s #%d: %s, after take, available = %d, want = %d", kind, i, test.about, c, test.expectCountAfterTake))
+			c = tb.available(tb.StartTime().Add(test.sleep))
+			asserts.Equal(c, test.expectCountAfterSleep, fmt.Sprintf("%s #%d: %s, after some time it should fill in new tokens, available = %d, want = %d",
+				kind, i, test.about, c, test.expectCountAfterSleep))
+			fmt.Println("GCRAAcquire2Tests:", kind, test.about, "-> success")
+		}
+	}
+}
+
+//------------------------------------TryAcquire Test------------------------------------------
+func TestGCRATryAcquire(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, kind := range storageKinds {
+		s := newStorage(kind, GCRA)
+		for i, test := range tryAcquireTests {
+			tb, err := s.Create(fmt.Sprintf("msf_gcra_bucket_:%d", i), test.fillInterval, test.capacity)
+			asserts.Nil(err, "Token bucket create failed")
+
+			for j, req := range test.reqs {
+				d, ok := tb.tryAcquire(tb.StartTime().Add(req.time), req.count, infinityDuration)
+				asserts.Equal(ok, true, fmt.Sprintf("unexpect: waitTime > maxWait(%v)", infinityDuration))
+				asserts.Equal(d, req.expectWait, fmt.Sprintf("%s test %d.%d, %s, got %v want %v", kind, i, j, test.about, d, req.expectWait))
+			}
+			fmt.Println("GCRATryAcquireTest:", kind, test.about, "-> success")
+		}
+	}
+}
+
+func TestGCRAContinuous(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, kind := range storageKinds {
+		tb, err := newStorage(kind, GCRA).CreateWithQuantum("msf_gcra_bucket", 30*time.Millisecond, 6, 3)
+		asserts.Nil(err, "Token bucket create failed")
+
+		// A token arrives every 10ms, from the time it is taken
+		// rather than on the ticks of the fill interval.
+		start := tb.StartTime()
+		asserts.Equal(int64(6), tb.acquire(start.Add(5*time.Millisecond), 6), kind)
+		asserts.Equal(int64(0), tb.available(start.Add(14*time.Millisecond)), kind)
+		asserts.Equal(int64(1), tb.available(start.Add(15*time.Millisecond)), kind)
+
+		d, ok := tb.tryAcquire(start.Add(15*time.Millisecond), 3, infinityDuration)
+		asserts.True(ok, kind)
+		asserts.Equal(20*time.Millisecond, d, kind)
+		_, ok = tb.tryAcquire(start.Add(15*time.Millisecond), 1, 25*time.Millisecond)
+		asserts.False(ok, kind)
+
+		asserts.Nil(tb.refund(start.Add(15*time.Millisecond), start.Add(15*time.Millisecond), 2), kind)
+		asserts.Equal(int64(0), tb.available(start.Add(15*time.Millisecond)), kind)
+		asserts.Equal(int64(1), tb.available(start.Add(25*time.Millisecond)), kind)
+
+		// Refunds never overflow the capacity.
+		asserts.Nil(tb.refund(start.Add(time.Second), start.Add(time.Second), 10), kind)
+		asserts.Equal(int64(6), tb.available(start.Add(time.Second)), kind)
+		fmt.Println("GCRAContinuousTest:", kind, "-> success")
+	}
+}
+
+func TestGCRARedisExpire(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	nrs.Algorithm = GCRA
+	nrs.Client.FlushDB()
+
+	tb, err := nrs.Create("msf_gcra_bucket", 100*time.Millisecond, 10)
+	asserts.Nil(err, "Token bucket create failed")
+	asserts.Equal(int64(0), nrs.Client.Exists("msf_gcra_bucket").Val(), "a full bucket stores nothing")
+
+	// The key lives as long as the bucket takes to refill.
+	start := time.Now()
+	asserts.Equal(int64(4), tb.acquire(start, 4))
+	ttl := nrs.Client.PTTL("msf_gcra_bucket").Val()
+	asserts.True(ttl > 300*time.Millisecond && ttl <= 400*time.Millisecond, fmt.Sprintf("got ttl %v", ttl))
+
+	// A full bucket is deleted.
+	asserts.Nil(tb.refund(start, start, 4))
+	asserts.Equal(int64(0), nrs.Client.Exists("msf_gcra_bucket").Val())
+	fmt.Println("GCRARedisExpireTest: -> success")
+}
+
+func TestGCRAFailLocal(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(downClient, bucketExpire)
+	nrs.Algorithm = GCRA
+	nrs.Policy = FailLocal
+
+	tb, err := nrs.Create("msf_gcra_bucket", time.Second, 2)
+	asserts.Nil(err, "Token bucket create failed")
+	asserts.Equal(int64(2), tb.Acquire(3))
+	asserts.IsType(&gcraBucket{}, tb.(*redisBucket).localBucket())
+	fmt.Println("GCRAFailLocalTest: -> success")
+}
+
+//------------------------------------Benchmark------------------------------------------
+func BenchmarkGCRAAcquireContended(b *testing.B) {
+	benchmarkContended(b, NewMemoryStorageWithOptions(MemoryOptions{Algorithm: GCRA}))
+}
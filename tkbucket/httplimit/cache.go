@@ -0,0 +1,76 @@
+package httplimit
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/mougeCM/ratelimiter/tkbucket"
+)
+
+// defaultCacheSize is the default Limiter.CacheSize.
+const defaultCacheSize = 10000
+
+// bucketCache holds the buckets of the most recently used keys,
+// the least recently used one is evicted beyond size buckets.
+type bucketCache struct {
+	mu    sync.Mutex
+	size  int
+	items map[string]*list.Element
+	// lru orders the cacheEntries from the most recently used.
+	lru *list.List
+}
+
+type cacheEntry struct {
+	key    string
+	bucket tkbucket.Bucket
+}
+
+func newBucketCache(size int) *bucketCache {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+	return &bucketCache{
+		size:  size,
+		items: make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+}
+
+// get returns the bucket of key, if cached.
+func (c *bucketCache) get(key string) (tkbucket.Bucket, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).bucket, true
+}
+
+// add caches the bucket of key, and returns the bucket cached
+// meanwhile by another request if any.
+func (c *bucketCache) add(key string, b tkbucket.Bucket) tkbucket.Bucket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*cacheEntry).bucket
+	}
+	c.items[key] = c.lru.PushFront(&cacheEntry{key: key, bucket: b})
+	if c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.items, e.Value.(*cacheEntry).key)
+	}
+	return b
+}
+
+// len returns the number of buckets cached.
+func (c *bucketCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
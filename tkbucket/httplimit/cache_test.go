@@ -0,0 +1,72 @@
+package httplimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mougeCM/ratelimiter/tkbucket"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingStorage counts the buckets created by CreateWithRate.
+type countingStorage struct {
+	tkbucket.Storage
+	creates int
+}
+
+func (s *countingStorage) CreateWithRate(name string, ratePerSecond float64, capacity int64) (tkbucket.Bucket, error) {
+	s.creates++
+	return s.Storage.CreateWithRate(name, ratePerSecond, capacity)
+}
+
+//------------------------------------Cache Test------------------------------------------
+func TestLimiterCache(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, kind := range storageKinds {
+		storage := &countingStorage{Storage: newStorage(kind)}
+		l := New(storage, 0.01, 2)
+		l.Prefix = "msf_http_cache:"
+		l.CacheSize = 2
+		now := time.Unix(1000, 0)
+
+		// The bucket of a key is created once.
+		serve(l, now, "10.0.0.1:1")
+		serve(l, now, "10.0.0.1:1")
+		asserts.Equal(1, storage.creates, kind)
+		asserts.Equal("0", serve(l, now, "10.0.0.1:1").Header().Get("X-RateLimit-Remaining"), kind)
+
+		// The least recently used bucket is evicted.
+		serve(l, now, "10.0.0.2:1")
+		serve(l, now, "10.0.0.1:1")
+		serve(l, now, "10.0.0.3:1")
+		asserts.Equal(3, storage.creates, kind)
+		asserts.Equal(2, l.cache.len(), kind)
+		serve(l, now, "10.0.0.1:1")
+		asserts.Equal(3, storage.creates, kind)
+		serve(l, now, "10.0.0.2:1")
+		asserts.Equal(4, storage.creates, kind)
+		fmt.Println("LimiterCacheTest:", kind, "-> success")
+	}
+}
+
+func TestLimiterNoCache(t *testing.T) {
+	asserts := assert.New(t)
+
+	storage := tkbucket.NewMemoryStorageWithOptions(tkbucket.MemoryOptions{MaxEntries: 1})
+	l := New(storage, 0.01, 2)
+	now := time.Unix(1000, 0)
+
+	// The requests take the tokens of the bucket kept by the storage.
+	serve(l, now, "10.0.0.1:1")
+	b, _ := storage.CreateWithRate("10.0.0.1", 0.01, 2)
+	asserts.Equal("0", serve(l, now, "10.0.0.1:1").Header().Get("X-RateLimit-Remaining"))
+	asserts.Equal(int64(0), b.Available())
+	asserts.Nil(l.cache)
+
+	// The bucket evicted by the storage is created again.
+	serve(l, now, "10.0.0.2:1")
+	asserts.Equal("1", serve(l, now, "10.0.0.1:1").Header().Get("X-RateLimit-Remaining"))
+	fmt.Println("LimiterNoCacheTest: -> success")
+}
@@ -0,0 +1,208 @@
+// Package httplimit limits the rate of the requests served by a net/http
+// handler, with a bucket of a tkbucket.Storage per key of the requests.
+//
+// The responses carry the legacy X-RateLimit-* headers and the headers of
+// the IETF draft: https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/
+//
+//	X-RateLimit-Limit      capacity of the bucket
+//	X-RateLimit-Remaining  tokens left in the bucket
+//	X-RateLimit-Reset      Unix time in seconds when the bucket is full again
+//	RateLimit-Limit        capacity of the bucket
+//	RateLimit-Remaining    tokens left in the bucket
+//	RateLimit-Reset        seconds until the bucket is full again
+//	RateLimit-Policy       capacity and window, e.g. 10;w=5 for 2 tokens per second
+//
+// The requests over the limit get a 429 Too Many Requests with a
+// Retry-After header in seconds.
+package httplimit
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mougeCM/ratelimiter/tkbucket"
+)
+
+// Limiter is a net/http middleware taking tokens from the bucket of the key
+// of every request, created in its Storage on first use. Storage, Rate,
+// Burst, Prefix and CacheSize must not be changed once it serves requests.
+type Limiter struct {
+	// Storage creates the buckets, refilled continuously with Rate tokens
+	// per second up to Burst tokens. A MemoryStorage keeps a bucket per key
+	// until it is evicted: keyed by IP, it grows without bound unless
+	// MemoryOptions.MaxEntries or MemoryOptions.IdleTimeout is set.
+	Storage tkbucket.Storage
+	Rate    float64
+	Burst   int64
+	// Prefix is prepended to the keys to name the buckets, e.g. to
+	// share a RedisStorage with other limiters.
+	Prefix string
+	// CacheSize is the number of buckets of the most recently used keys
+	// kept by the Limiter, so that the Storage creates a bucket once rather
+	// than on every request. It defaults to 10000. The MemoryStorage and the
+	// HybridStorage keep their buckets themselves and are not cached: a
+	// bucket used through the cache would be evicted as idle.
+	CacheSize int
+	// Key returns the key of the bucket of a request, it defaults to IP().
+	Key KeyFunc
+	// Cost returns the tokens taken by a request, it defaults to 1.
+	Cost func(r *http.Request) int64
+	// DenyHandler responds to the requests over the limit, once the
+	// headers are set. It defaults to a 429 Too Many Requests.
+	DenyHandler func(w http.ResponseWriter, r *http.Request, d tkbucket.Decision)
+	// ErrorHandler responds when the key or the bucket of a request cannot
+	// be got. It defaults to a 400 Bad Request for the errors of ErrNoKey,
+	// and to a 500 Internal Server Error otherwise.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+	// cacheOnce guards cache, created on first use.
+	cacheOnce sync.Once
+	cache     *bucketCache
+}
+
+// New creates a Limiter with buckets of storage refilled with ratePerSecond
+// tokens per second up to burst tokens, keyed by the IP of the client. See
+// Limiter.Storage for the buckets kept by a MemoryStorage.
+func New(storage tkbucket.Storage, ratePerSecond float64, burst int64) *Limiter {
+	if !(ratePerSecond > 0) {
+		panic("http limiter rate is not > 0")
+	}
+	if burst <= 0 {
+		panic("http limiter burst is not > 0")
+	}
+	// The buckets are created on the first requests, a rate the storage
+	// rejects panics here rather than in every request.
+	tkbucket.NewMemoryStorage().CreateWithRate("", ratePerSecond, burst)
+	return &Limiter{
+		Storage: storage,
+		Rate:    ratePerSecond,
+		Burst:   burst,
+		Key:     IP(),
+	}
+}
+
+// Handler returns a handler serving the requests with next
+// while they are under the limit.
+func (l *Limiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.serve(time.Now(), w, r, next)
+	})
+}
+
+// serve is the internal version of Handler - to enable easy testing.
+func (l *Limiter) serve(now time.Time, w http.ResponseWriter, r *http.Request, next http.Handler) {
+	d, err := l.allow(r)
+	if err != nil {
+		l.fail(w, r, err)
+		return
+	}
+	l.setHeaders(now, w.Header(), d)
+	if !d.Allowed {
+		l.deny(w, r, d)
+		return
+	}
+	next.ServeHTTP(w, r)
+}
+
+// allow takes the tokens of r from the bucket of its key.
+func (l *Limiter) allow(r *http.Request) (tkbucket.Decision, error) {
+	key := l.Key
+	if key == nil {
+		key = IP()
+	}
+	k, err := key(r)
+	if err != nil {
+		return tkbucket.Decision{}, err
+	}
+	b, err := l.bucket(l.Prefix + k)
+	if err != nil {
+		return tkbucket.Decision{}, err
+	}
+	cost := int64(1)
+	if l.Cost != nil {
+		cost = l.Cost(r)
+	}
+	return b.Allow(cost), nil
+}
+
+// bucket returns the bucket of name from the cache,
+// or creates it in the Storage.
+func (l *Limiter) bucket(name string) (tkbucket.Bucket, error) {
+	switch l.Storage.(type) {
+	case *tkbucket.MemoryStorage, *tkbucket.HybridStorage:
+		return l.Storage.CreateWithRate(name, l.Rate, l.Burst)
+	}
+	l.cacheOnce.Do(func() {
+		l.cache = newBucketCache(l.CacheSize)
+	})
+	if b, ok := l.cache.get(name); ok {
+		return b, nil
+	}
+	b, err := l.Storage.CreateWithRate(name, l.Rate, l.Burst)
+	if err != nil {
+		return nil, err
+	}
+	return l.cache.add(name, b), nil
+}
+
+// setHeaders sets the rate limit headers of d at now.
+func (l *Limiter) setHeaders(now time.Time, h http.Header, d tkbucket.Decision) {
+	limit := strconv.FormatInt(d.Limit, 10)
+	remaining := strconv.FormatInt(d.Remaining, 10)
+	reset := seconds(d.ResetAfter)
+	h.Set("X-RateLimit-Limit", limit)
+	h.Set("X-RateLimit-Remaining", remaining)
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(now.Unix()+reset, 10))
+	h.Set("RateLimit-Limit", limit)
+	h.Set("RateLimit-Remaining", remaining)
+	h.Set("RateLimit-Reset", strconv.FormatInt(reset, 10))
+	h.Set("RateLimit-Policy", l.policy(d.Limit))
+	// The tokens never arrive if the cost exceeds the capacity.
+	if !d.Allowed && d.RetryAfter < math.MaxInt64 {
+		h.Set("Retry-After", strconv.FormatInt(seconds(d.RetryAfter), 10))
+	}
+}
+
+// policy returns the RateLimit-Policy of a bucket of capacity limit: the
+// limit and the window in which it refills, in whole seconds.
+func (l *Limiter) policy(limit int64) string {
+	w := int64(math.Ceil(float64(limit) / l.Rate))
+	if w < 1 {
+		w = 1
+	}
+	return strconv.FormatInt(limit, 10) + ";w=" + strconv.FormatInt(w, 10)
+}
+
+func (l *Limiter) deny(w http.ResponseWriter, r *http.Request, d tkbucket.Decision) {
+	if l.DenyHandler != nil {
+		l.DenyHandler(w, r, d)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+func (l *Limiter) fail(w http.ResponseWriter, r *http.Request, err error) {
+	if l.ErrorHandler != nil {
+		l.ErrorHandler(w, r, err)
+		return
+	}
+	if errors.Is(err, ErrNoKey) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// seconds returns d in whole seconds, rounded up so that a
+// client waiting for them is never early.
+func seconds(d time.Duration) int64 {
+	s := int64(d / time.Second)
+	if d%time.Second > 0 {
+		s++
+	}
+	return s
+}
@@ -0,0 +1,150 @@
+package httplimit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mougeCM/ratelimiter/tkbucket"
+	"github.com/stretchr/testify/assert"
+)
+
+// ok responds 200 OK.
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+// serve serves a request from remoteAddr at now with the handler of l.
+func serve(l *Limiter, now time.Time, remoteAddr string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	l.serve(now, w, newRequest("/", remoteAddr, nil), ok)
+	return w
+}
+
+//------------------------------------Limiter Test------------------------------------------
+func TestLimiter(t *testing.T) {
+	asserts := assert.New(t)
+
+	// A token every 100 seconds, nothing is refilled during the test.
+	var limiterTests = []struct {
+		remoteAddr string
+		status     int
+		remaining  string
+		reset      int64
+		retryAfter string
+	}{
+		{"10.0.0.1:1", http.StatusOK, "1", 100, ""},
+		{"10.0.0.1:2", http.StatusOK, "0", 200, ""},
+		{"10.0.0.1:3", http.StatusTooManyRequests, "0", 200, "100"},
+		{"10.0.0.2:1", http.StatusOK, "1", 100, ""},
+	}
+	for _, kind := range storageKinds {
+		l := New(newStorage(kind), 0.01, 2)
+		l.Prefix = "msf_http:"
+		now := time.Unix(1000, 0)
+		for i, test := range limiterTests {
+			w := serve(l, now, test.remoteAddr)
+			about := fmt.Sprintf("%s #%d", kind, i)
+			h := w.Header()
+			asserts.Equal(test.status, w.Code, about)
+			asserts.Equal("2", h.Get("X-RateLimit-Limit"), about)
+			asserts.Equal(test.remaining, h.Get("X-RateLimit-Remaining"), about)
+			asserts.Equal(strconv.FormatInt(1000+test.reset, 10), h.Get("X-RateLimit-Reset"), about)
+			asserts.Equal("2", h.Get("RateLimit-Limit"), about)
+			asserts.Equal(test.remaining, h.Get("RateLimit-Remaining"), about)
+			asserts.Equal(strconv.FormatInt(test.reset, 10), h.Get("RateLimit-Reset"), about)
+			asserts.Equal("2;w=200", h.Get("RateLimit-Policy"), about)
+			asserts.Equal(test.retryAfter, h.Get("Retry-After"), about)
+		}
+		fmt.Println("LimiterTest:", kind, "-> success")
+	}
+}
+
+func TestNewPanics(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, rate := range []float64{0, 1e-12, 1e15} {
+		asserts.Panics(func() { New(tkbucket.NewMemoryStorage(), rate, 1) }, fmt.Sprintf("rate %v", rate))
+	}
+	asserts.Panics(func() { New(tkbucket.NewMemoryStorage(), 1, 0) }, "burst 0")
+	fmt.Println("NewPanicsTest: -> success")
+}
+
+func TestLimiterCost(t *testing.T) {
+	asserts := assert.New(t)
+
+	l := New(tkbucket.NewMemoryStorage(), 1, 5)
+	l.Key = Header("X-API-Key")
+	l.Cost = func(r *http.Request) int64 {
+		n, _ := strconv.ParseInt(r.URL.Query().Get("n"), 10, 64)
+		return n
+	}
+	handler := l.Handler(ok)
+
+	var costTests = []struct {
+		target     string
+		status     int
+		retryAfter string
+	}{
+		{"/?n=3", http.StatusOK, ""},
+		{"/?n=3", http.StatusTooManyRequests, "1"},
+		// The tokens never fit in the bucket.
+		{"/?n=6", http.StatusTooManyRequests, ""},
+		{"/?n=2", http.StatusOK, ""},
+	}
+	for i, test := range costTests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest(test.target, "10.0.0.1:1", http.Header{"X-Api-Key": {"k1"}}))
+		asserts.Equal(test.status, w.Code, fmt.Sprintf("#%d", i))
+		asserts.Equal(test.retryAfter, w.Header().Get("Retry-After"), fmt.Sprintf("#%d", i))
+	}
+
+	// A request without a key is rejected.
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest("/?n=1", "10.0.0.1:1", nil))
+	asserts.Equal(http.StatusBadRequest, w.Code)
+	fmt.Println("LimiterCostTest: -> success")
+}
+
+func TestLimiterHandlers(t *testing.T) {
+	asserts := assert.New(t)
+
+	l := New(tkbucket.NewMemoryStorage(), 0.01, 1)
+	l.DenyHandler = func(w http.ResponseWriter, r *http.Request, d tkbucket.Decision) {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(d.RetryAfter/time.Hour), 10))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	var handlerErr error
+	l.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		handlerErr = err
+		w.WriteHeader(http.StatusForbidden)
+	}
+
+	now := time.Now()
+	asserts.Equal(http.StatusOK, serve(l, now, "10.0.0.1:1").Code)
+	w := serve(l, now, "10.0.0.1:1")
+	asserts.Equal(http.StatusServiceUnavailable, w.Code)
+	asserts.Equal("0", w.Header().Get("Retry-After"))
+	asserts.Equal("0", w.Header().Get("RateLimit-Remaining"), "the headers are set before the deny handler")
+
+	w = serve(l, now, "pipe")
+	asserts.Equal(http.StatusForbidden, w.Code)
+	asserts.True(errors.Is(handlerErr, ErrNoKey))
+
+	// The storage errors are passed to the error handler.
+	nrs := newStorage("redis").(*tkbucket.RedisStorage)
+	_, err := nrs.Create("msf_http_conflict:10.0.0.1", time.Second, 1)
+	asserts.Nil(err)
+	l = New(nrs, 0.01, 1)
+	l.Prefix = "msf_http_conflict:"
+	l.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		handlerErr = err
+		w.WriteHeader(http.StatusForbidden)
+	}
+	w = serve(l, now, "10.0.0.1:1")
+	asserts.Equal(http.StatusForbidden, w.Code)
+	asserts.True(errors.Is(handlerErr, tkbucket.ErrBucketConflict))
+	fmt.Println("LimiterHandlersTest: -> success")
+}
@@ -0,0 +1,85 @@
+package httplimit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ErrNoKey is returned by a KeyFunc when the request lacks its key.
+var ErrNoKey = errors.New("httplimit: no key in request")
+
+// KeyFunc returns the key of the bucket limiting a request.
+type KeyFunc func(r *http.Request) (string, error)
+
+// IP returns the IP of the client. Behind a proxy, headers names the headers
+// set by the proxy, e.g. X-Forwarded-For or X-Real-IP: the last address of
+// the first header present is used, as a list may be prefixed by the client.
+// It falls back to the remote address of the connection.
+func IP(headers ...string) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		for _, name := range headers {
+			v := r.Header.Values(name)
+			if len(v) == 0 {
+				continue
+			}
+			addrs := strings.Split(v[len(v)-1], ",")
+			if ip := net.ParseIP(strings.TrimSpace(addrs[len(addrs)-1])); ip != nil {
+				return ip.String(), nil
+			}
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return "", fmt.Errorf("%w: remote address %q", ErrNoKey, r.RemoteAddr)
+		}
+		return ip.String(), nil
+	}
+}
+
+// Header returns the value of the header name, e.g. an API key.
+func Header(name string) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		v := r.Header.Get(name)
+		if v == "" {
+			return "", fmt.Errorf("%w: header %s", ErrNoKey, name)
+		}
+		return v, nil
+	}
+}
+
+// Query returns the value of the query parameter name.
+func Query(name string) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			return "", fmt.Errorf("%w: query parameter %s", ErrNoKey, name)
+		}
+		return v, nil
+	}
+}
+
+// keyEscaper escapes the separator of the composed keys.
+var keyEscaper = strings.NewReplacer(`\`, `\\`, `:`, `\:`)
+
+// Compose returns the keys of keys joined by ":", e.g. Compose(Route(), IP())
+// limits each client on each route. The colons of the keys are escaped, so
+// that two requests share a key only if all their keys are equal.
+func Compose(keys ...KeyFunc) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		parts := make([]string, len(keys))
+		for i, key := range keys {
+			k, err := key(r)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = keyEscaper.Replace(k)
+		}
+		return strings.Join(parts, ":"), nil
+	}
+}
@@ -0,0 +1,60 @@
+package httplimit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newRequest returns a request from remoteAddr with the headers of header.
+func newRequest(target, remoteAddr string, header http.Header) *http.Request {
+	r := httptest.NewRequest("GET", target, nil)
+	r.RemoteAddr = remoteAddr
+	for name, values := range header {
+		for _, v := range values {
+			r.Header.Add(name, v)
+		}
+	}
+	return r
+}
+
+//------------------------------------Key Test------------------------------------------
+func TestKeyFunc(t *testing.T) {
+	asserts := assert.New(t)
+
+	var keyTests = []struct {
+		about  string
+		key    KeyFunc
+		r      *http.Request
+		expect string
+		noKey  bool
+	}{
+		{"ip", IP(), newRequest("/", "10.0.0.1:1234", nil), "10.0.0.1", false},
+		{"ipv6", IP(), newRequest("/", "[2001:db8::1]:1234", nil), "2001:db8::1", false},
+		{"ip without port", IP(), newRequest("/", "10.0.0.1", nil), "10.0.0.1", false},
+		{"bad ip", IP(), newRequest("/", "pipe", nil), "", true},
+		{"forwarded ip", IP("X-Forwarded-For"),
+			newRequest("/", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"1.1.1.1, 2.2.2.2", "3.3.3.3"}}), "3.3.3.3", false},
+		{"first forwarded header", IP("X-Real-IP", "X-Forwarded-For"),
+			newRequest("/", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"1.1.1.1, 2.2.2.2"}}), "2.2.2.2", false},
+		{"bad forwarded ip", IP("X-Forwarded-For"),
+			newRequest("/", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"unknown"}}), "10.0.0.1", false},
+		{"header", Header("X-API-Key"), newRequest("/", "10.0.0.1:1234", http.Header{"X-Api-Key": {"k1"}}), "k1", false},
+		{"no header", Header("X-API-Key"), newRequest("/", "10.0.0.1:1234", nil), "", true},
+		{"query", Query("user"), newRequest("/?user=u1", "10.0.0.1:1234", nil), "u1", false},
+		{"no query", Query("user"), newRequest("/?id=u1", "10.0.0.1:1234", nil), "", true},
+		{"compose", Compose(Header("X-API-Key"), IP()),
+			newRequest("/", "[::1]:1234", http.Header{"X-Api-Key": {`k:1\`}}), `k\:1\\:\:\:1`, false},
+		{"compose no key", Compose(IP(), Header("X-API-Key")), newRequest("/", "10.0.0.1:1234", nil), "", true},
+	}
+	for _, test := range keyTests {
+		k, err := test.key(test.r)
+		asserts.Equal(test.expect, k, test.about)
+		asserts.Equal(test.noKey, errors.Is(err, ErrNoKey), test.about)
+	}
+	fmt.Println("KeyFuncTest: -> success")
+}
@@ -0,0 +1,23 @@
+//go:build go1.23
+
+package httplimit
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Route returns the pattern of the http.ServeMux route matching the request,
+// e.g. "GET /users/{id}", so that all the paths of a route share a bucket.
+// The pattern is only known to the handlers of the routes: the Limiter must
+// wrap the handlers registered in the mux rather than the mux itself. The
+// mux sets Request.Pattern since Go 1.23, which Route needs, unless the
+// httpmuxgo121 setting restores the mux of Go 1.21.
+func Route() KeyFunc {
+	return func(r *http.Request) (string, error) {
+		if r.Pattern == "" {
+			return "", fmt.Errorf("%w: no route pattern", ErrNoKey)
+		}
+		return r.Pattern, nil
+	}
+}
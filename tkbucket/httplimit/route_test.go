@@ -0,0 +1,41 @@
+//go:build go1.23
+
+// Request.Pattern is set by the mux of Go 1.23, which is not the default
+// of the packages built without a go.mod.
+//go:debug httpmuxgo121=0
+
+package httplimit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//------------------------------------Route Test------------------------------------------
+func TestRoute(t *testing.T) {
+	asserts := assert.New(t)
+
+	_, err := Route()(newRequest("/", "10.0.0.1:1234", nil))
+	asserts.True(errors.Is(err, ErrNoKey), "no route")
+
+	var keys []string
+	mux := http.NewServeMux()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		k, err := Compose(Route(), Query("id"))(r)
+		asserts.Nil(err)
+		keys = append(keys, k)
+	})
+	mux.Handle("GET /users/{id}", handler)
+	mux.Handle("/", handler)
+
+	for _, target := range []string{"/users/1?id=a", "/users/2?id=a", "/other?id=b"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+	asserts.Equal([]string{"GET /users/{id}:a", "GET /users/{id}:a", "/:b"}, keys)
+	fmt.Println("RouteTest: -> success")
+}
@@ -0,0 +1,25 @@
+package httplimit
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/mougeCM/ratelimiter/tkbucket"
+)
+
+// storageKinds are the kinds of the storages the tests run against,
+// as in the tests of tkbucket, whose test files are not importable.
+var storageKinds = []string{"memory", "redis"}
+
+var redisClient = redis.NewClient(&redis.Options{Addr: ":6379"})
+
+// newStorage returns an empty storage of kind.
+func newStorage(kind string) tkbucket.Storage {
+	if kind == "memory" {
+		return tkbucket.NewMemoryStorage()
+	}
+	nrs := tkbucket.NewRedisStorage(redisClient, time.Hour)
+	// NOTE: Reset data
+	nrs.Client.FlushDB()
+	return nrs
+}
@@ -0,0 +1,534 @@
+package tkbucket
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// hybridBucket serves tokens leased in batches from a redisBucket,
+// so that most requests don't need a round trip to Redis.
+type hybridBucket struct {
+	remote *redisBucket
+	// storage holds the HybridStorage which created the bucket.
+	storage *HybridStorage
+	// elem holds the position of the bucket in the LRU list of the
+	// storage, if MaxEntries is set. It is guarded by storage.mu.
+	elem *list.Element
+	// batch holds how many tokens are leased from Redis at a time.
+	batch int64
+	// leaseTTL holds how long the leased tokens may be kept
+	// before the unused ones are returned to Redis.
+	leaseTTL time.Duration
+	// mu guards the fields below it.
+	mu sync.Mutex
+	// leased holds the number of tokens leased from Redis
+	// and not used yet.
+	leased int64
+	// timer returns the unused tokens when the lease expires.
+	timer *time.Timer
+	// closed holds whether the storage is closed: nothing is leased
+	// anymore, the calls go straight to Redis.
+	closed bool
+}
+
+func (b *hybridBucket) StartTime() time.Time {
+	return b.remote.StartTime()
+}
+
+func (b *hybridBucket) Capacity() int64 {
+	return b.remote.Capacity()
+}
+
+// Acquire takes up to count immediately available tokens from the bucket
+// result > 0，sufficient token
+func (b *hybridBucket) Acquire(count int64) int64 {
+	return b.acquire(time.Now(), count)
+}
+
+// TryAcquire try to acquire the token from the bucket.
+// It returns infinityDuration if the request is refused by FailClosed.
+func (b *hybridBucket) TryAcquire(count int64) time.Duration {
+	d, ok := b.tryAcquire(time.Now(), count, infinityDuration)
+	if !ok {
+		return infinityDuration
+	}
+	return d
+}
+
+// Wait try to acquire the token from the bucket and wait util to get it.
+// It returns immediately if the request is refused by FailClosed,
+// use WaitContext to know about it.
+func (b *hybridBucket) Wait(count int64) {
+	if d, ok := b.tryAcquire(time.Now(), count, infinityDuration); ok && d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// WaitContext try to acquire the token from the bucket and wait util to get it,
+// or until ctx is done.
+func (b *hybridBucket) WaitContext(ctx context.Context, count int64) error {
+	return waitContext(ctx, b, count)
+}
+
+// WaitMaxDuration try to acquire the token from the bucket and wait util to get it,
+// if it needs to wait for no greater than maxWait.
+func (b *hybridBucket) WaitMaxDuration(count int64, maxWait time.Duration) bool {
+	return waitMaxDuration(b, count, maxWait)
+}
+
+// Reserve books count tokens from the bucket, see Reservation.
+func (b *hybridBucket) Reserve(count int64) *Reservation {
+	return reserve(b, time.Now(), count, infinityDuration)
+}
+
+// Available returns the number of available tokens,
+// leased tokens included.
+func (b *hybridBucket) Available() int64 {
+	return b.available(time.Now())
+}
+
+// AcquireE is like Acquire, but reports why no token could be taken.
+// The FailurePolicy of the RedisStorage is applied.
+func (b *hybridBucket) AcquireE(count int64) (int64, error) {
+	return b.acquireE(time.Now(), count)
+}
+
+// TryAcquireE is like TryAcquire, but reports storage failures.
+// The FailurePolicy of the RedisStorage is applied.
+func (b *hybridBucket) TryAcquireE(count int64) (time.Duration, error) {
+	return b.tryAcquireE(time.Now(), count, infinityDuration)
+}
+
+// AvailableE is like Available, but reports storage failures.
+// The FailurePolicy of the RedisStorage is applied.
+func (b *hybridBucket) AvailableE() (int64, error) {
+	return b.availableE(time.Now())
+}
+
+// Allow takes count tokens if they are all available, see Decision.
+// While the leased tokens last, the Decision is made in the process:
+// Remaining holds the leased tokens left and ResetAfter is 0.
+// The FailurePolicy of the RedisStorage is applied.
+func (b *hybridBucket) Allow(count int64) Decision {
+	return b.allow(time.Now(), count)
+}
+
+// AllowE is like Allow, but reports storage failures.
+// The FailurePolicy of the RedisStorage is applied.
+func (b *hybridBucket) AllowE(count int64) (Decision, error) {
+	return b.allowE(time.Now(), count)
+}
+
+func (b *hybridBucket) acquire(now time.Time, count int64) int64 {
+	n, _ := b.acquireE(now, count)
+	return n
+}
+
+func (b *hybridBucket) tryAcquire(now time.Time, count int64, maxWait time.Duration) (time.Duration, bool) {
+	d, err := b.tryAcquireE(now, count, maxWait)
+	return d, err == nil
+}
+
+func (b *hybridBucket) available(now time.Time) int64 {
+	n, _ := b.availableE(now)
+	return n
+}
+
+func (b *hybridBucket) allow(now time.Time, count int64) Decision {
+	d, _ := b.allowE(now, count)
+	return d
+}
+
+func (b *hybridBucket) acquireE(now time.Time, count int64) (int64, error) {
+	if count <= 0 {
+		return 0, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.attach()
+	if b.closed {
+		return b.remote.acquireE(now, count)
+	}
+	if b.leased < count {
+		if err := b.lease(now, 1, count-b.leased); err != nil {
+			// Take what is leased, and apply the FailurePolicy
+			// for the rest without calling Redis again.
+			taken := b.leased
+			b.leased = 0
+			n, err := b.remote.failAcquire(now, count-taken, err)
+			if taken > 0 {
+				return taken + n, nil
+			}
+			return n, err
+		}
+	}
+	if count > b.leased {
+		count = b.leased
+	}
+	b.leased -= count
+	return count, nil
+}
+
+func (b *hybridBucket) tryAcquireE(now time.Time, count int64, maxWait time.Duration) (time.Duration, error) {
+	if count <= 0 {
+		return 0, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.attach()
+	if b.closed {
+		return b.remote.tryAcquireE(now, count, maxWait)
+	}
+	var err error
+	if b.leased < count {
+		err = b.lease(now, count-b.leased, count-b.leased)
+	}
+	if b.leased >= count {
+		b.leased -= count
+		return 0, nil
+	}
+
+	// Not enough tokens right now, book the missing ones in Redis
+	// and keep the leased ones if the wait is refused. If Redis
+	// failed to lease, the FailurePolicy is applied right away.
+	var d time.Duration
+	if err != nil {
+		d, err = b.remote.failTryAcquire(now, count-b.leased, maxWait, err)
+	} else {
+		d, err = b.remote.tryAcquireE(now, count-b.leased, maxWait)
+	}
+	if err != nil {
+		return 0, err
+	}
+	b.leased = 0
+	return d, nil
+}
+
+func (b *hybridBucket) allowE(now time.Time, count int64) (Decision, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.attach()
+	if b.closed {
+		return b.remote.allowE(now, count)
+	}
+	var err error
+	if count > 0 && b.leased < count {
+		err = b.lease(now, count-b.leased, count-b.leased)
+	}
+	if b.leased >= count {
+		granted := maxInt64(count, 0)
+		b.leased -= granted
+		return Decision{Allowed: true, Granted: granted, Remaining: b.leased, Limit: b.remote.capacity}, nil
+	}
+
+	// Not enough tokens, Redis decides for the missing ones
+	// and tells when they are available. If Redis failed to
+	// lease, the FailurePolicy is applied right away.
+	var d Decision
+	if err != nil {
+		d, err = b.remote.failAllow(now, count-b.leased, err)
+	} else {
+		d, err = b.remote.allowE(now, count-b.leased)
+	}
+	if err != nil {
+		return d, err
+	}
+	if d.Allowed {
+		d.Granted = count
+		b.leased = 0
+	} else {
+		d.Remaining += b.leased
+		if d.Remaining > d.Limit {
+			d.Remaining = d.Limit
+		}
+	}
+	return d, nil
+}
+
+func (b *hybridBucket) availableE(now time.Time) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n, err := b.remote.availableE(now)
+	if err != nil {
+		return 0, err
+	}
+	n += b.leased
+	if c := b.remote.capacity; n > c {
+		n = c
+	}
+	return n, nil
+}
+
+// refund gives the tokens back to Redis, so that they may
+// be used by other processes.
+func (b *hybridBucket) refund(now, at time.Time, count int64) error {
+	return b.remote.refund(now, at, count)
+}
+
+// lease takes at least need tokens from Redis, and up to the batch size.
+func (b *hybridBucket) lease(now time.Time, need, want int64) error {
+	if want < b.batch {
+		want = b.batch
+	}
+	n, err := b.remote.evalLease(now, need, want)
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return nil
+	}
+	b.leased += n
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.leaseTTL, b.expire)
+	} else {
+		b.timer.Reset(b.leaseTTL)
+	}
+	return nil
+}
+
+// expire returns the unused leased tokens to Redis, and drops the
+// bucket from the storage which has nothing left to keep for it.
+func (b *hybridBucket) expire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.release(); err != nil {
+		// Try again later, the tokens stay usable meanwhile.
+		b.timer = time.AfterFunc(b.leaseTTL, b.expire)
+		return
+	}
+	if b.storage != nil {
+		b.storage.drop(b)
+	}
+}
+
+// attach adds the bucket to its storage again before it leases tokens, if
+// the caller kept it after it was dropped, so that Close returns them. The
+// bucket goes straight to Redis if the storage is closed, b.mu must be held.
+func (b *hybridBucket) attach() {
+	if b.timer == nil && !b.closed && b.storage != nil {
+		b.closed = !b.storage.attach(b)
+	}
+}
+
+// release returns the unused leased tokens to Redis, b.mu must be held.
+// The timer is only stopped once the tokens are returned, so that it
+// tries again if Redis fails.
+func (b *hybridBucket) release() error {
+	if b.leased > 0 {
+		now := time.Now()
+		if err := b.remote.evalRefund(now, now, b.leased); err != nil {
+			return err
+		}
+		b.leased = 0
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return nil
+}
+
+// close stops leasing tokens and returns the unused ones to Redis,
+// b.mu must be held. If Redis fails, they are returned when the
+// lease expires.
+func (b *hybridBucket) close() error {
+	b.closed = true
+	err := b.release()
+	if err != nil && b.timer == nil {
+		b.timer = time.AfterFunc(b.leaseTTL, b.expire)
+	}
+	return err
+}
+
+// HybridStorage is a hybridBucket factory. The buckets are stored in Redis,
+// but the tokens are leased in batches and served from the local process,
+// so the limits are shared between processes while most of the calls stay
+// in-process. Up to batch tokens per bucket and process may be held back
+// from the other processes until the lease expires.
+//
+// A bucket is dropped from the storage once its lease expires, or when it
+// is the least recently used beyond MaxEntries: its state is in Redis,
+// and the caller should get the bucket from Create on every use.
+type HybridStorage struct {
+	Redis *RedisStorage
+	// Batch holds how many tokens are leased from Redis at a time.
+	Batch int64
+	// LeaseTTL holds how long the leased tokens are kept
+	// before the unused ones are returned to Redis.
+	LeaseTTL time.Duration
+	// MaxEntries bounds the number of buckets leasing tokens, the least
+	// recently used ones return their leased tokens to Redis and are
+	// dropped beyond it. Zero means no bound but the LeaseTTL.
+	MaxEntries int
+	// mu guards the fields below it. It may be locked while the
+	// mutex of a bucket is held, not the other way round.
+	mu      sync.Mutex
+	buckets map[string]*hybridBucket
+	// lru holds the buckets, the most recently used first,
+	// if MaxEntries is set.
+	lru    *list.List
+	closed bool
+}
+
+// NewHybridStorage initializes the hybridBucket store on top of a RedisStorage,
+// which must use the TokenBucket algorithm.
+func NewHybridStorage(redis *RedisStorage, batch int64, leaseTTL time.Duration) *HybridStorage {
+	if batch <= 0 {
+		panic("token bucket lease batch is not > 0")
+	}
+	if leaseTTL <= 0 {
+		panic("token bucket lease ttl is not > 0")
+	}
+	if redis.Algorithm != TokenBucket {
+		panic("token bucket lease needs the token bucket algorithm")
+	}
+	return &HybridStorage{
+		Redis:    redis,
+		Batch:    batch,
+		LeaseTTL: leaseTTL,
+		buckets:  make(map[string]*hybridBucket),
+		lru:      list.New(),
+	}
+}
+
+func (s *HybridStorage) Ping() error {
+	return s.Redis.Ping()
+}
+
+// Create create a hybridBucket.
+func (s *HybridStorage) Create(key string, fillInterval time.Duration, capacity int64) (Bucket, error) {
+	return s.CreateWithQuantum(key, fillInterval, capacity, 1)
+}
+
+// CreateWithQuantum create a hybridBucket with quantum.
+func (s *HybridStorage) CreateWithQuantum(key string, fillInterval time.Duration, capacity, quantum int64) (Bucket, error) {
+	return s.create(key, func() (Bucket, error) {
+		return s.Redis.CreateWithQuantum(key, fillInterval, capacity, quantum)
+	})
+}
+
+// CreateWithRate create a hybridBucket refilled continuously with
+// ratePerSecond tokens per second, see Storage.
+func (s *HybridStorage) CreateWithRate(key string, ratePerSecond float64, capacity int64) (Bucket, error) {
+	return s.create(key, func() (Bucket, error) {
+		return s.Redis.CreateWithRate(key, ratePerSecond, capacity)
+	})
+}
+
+// create returns the hybridBucket of key, leasing from the redisBucket
+// created by newBucket if it does not exist.
+func (s *HybridStorage) create(key string, newBucket func() (Bucket, error)) (Bucket, error) {
+	s.mu.Lock()
+	b, ok := s.buckets[key]
+	if ok {
+		if s.MaxEntries > 0 && b.elem != nil {
+			s.lru.MoveToFront(b.elem)
+		}
+		s.mu.Unlock()
+		return b, nil
+	}
+	rb, err := newBucket()
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	b = &hybridBucket{
+		remote:   rb.(*redisBucket),
+		storage:  s,
+		batch:    s.Batch,
+		leaseTTL: s.LeaseTTL,
+		closed:   s.closed,
+	}
+	s.add(b)
+	var victims []*hybridBucket
+	for s.MaxEntries > 0 && s.lru.Len() > s.MaxEntries {
+		victim := s.lru.Back().Value.(*hybridBucket)
+		s.remove(victim)
+		victims = append(victims, victim)
+	}
+	s.mu.Unlock()
+
+	// The leased tokens are returned without holding the storage.
+	for _, victim := range victims {
+		victim.mu.Lock()
+		// If Redis fails, they are returned when the lease expires.
+		_ = victim.release()
+		victim.mu.Unlock()
+	}
+	return b, nil
+}
+
+// attach adds b to the storage if the key has no bucket, and
+// reports whether the storage is still open. The least recently
+// used buckets are dropped by the next create.
+func (s *HybridStorage) attach(b *hybridBucket) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if _, ok := s.buckets[b.remote.Key]; !ok {
+		s.add(b)
+	}
+	return true
+}
+
+// drop removes b from the storage, if it is the bucket of its key.
+func (s *HybridStorage) drop(b *hybridBucket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.buckets[b.remote.Key] == b {
+		s.remove(b)
+	}
+}
+
+// add adds b to the storage, s.mu must be held.
+func (s *HybridStorage) add(b *hybridBucket) {
+	s.buckets[b.remote.Key] = b
+	if s.MaxEntries > 0 {
+		b.elem = s.lru.PushFront(b)
+	}
+}
+
+// remove removes b from the storage, s.mu must be held.
+func (s *HybridStorage) remove(b *hybridBucket) {
+	delete(s.buckets, b.remote.Key)
+	if b.elem != nil {
+		s.lru.Remove(b.elem)
+		b.elem = nil
+	}
+}
+
+// Close returns the unused leased tokens of every bucket to Redis, the
+// buckets then go straight to Redis without leasing tokens. The tokens
+// which could not be returned are returned when their lease expires.
+func (s *HybridStorage) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	buckets := make([]*hybridBucket, 0, len(s.buckets))
+	for _, b := range s.buckets {
+		buckets = append(buckets, b)
+	}
+	s.mu.Unlock()
+
+	var first error
+	for _, b := range buckets {
+		b.mu.Lock()
+		if err := b.close(); err != nil && first == nil {
+			first = err
+		}
+		b.mu.Unlock()
+	}
+	return first
+}
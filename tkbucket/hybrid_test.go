@@ -0,0 +1,232 @@
+package tkbucket
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHybridAcquire(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	// NOTE: Reset data
+	nrs.Client.FlushDB()
+
+	nhs := NewHybridStorage(nrs, 4, time.Hour)
+	defer nhs.Close()
+	tb, err := nhs.Create("msf_token_bucket", time.Hour, 10)
+	asserts.Nil(err, "Token bucket create failed")
+	tb2, _ := nhs.Create("msf_token_bucket", time.Hour, 10)
+	asserts.Equal(tb, tb2, "buckets are cached by key")
+	remote := tb.(*hybridBucket).remote
+	start := remote.StartTime()
+
+	// The first call leases a batch, the next ones are served locally.
+	asserts.Equal(int64(1), tb.acquire(start, 1))
+	asserts.Equal(int64(6), remote.available(start))
+	asserts.Equal(int64(9), tb.available(start))
+	asserts.Equal(int64(3), tb.acquire(start, 3))
+	asserts.Equal(int64(6), remote.available(start))
+
+	// More than the batch is leased at once when needed.
+	asserts.Equal(int64(5), tb.acquire(start, 5))
+	asserts.Equal(int64(1), remote.available(start))
+	asserts.Equal(int64(1), tb.acquire(start, 5))
+	asserts.Equal(int64(0), tb.acquire(start, 1))
+	fmt.Println("HybridAcquireTest: -> success")
+}
+
+func TestHybridTryAcquire(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	// NOTE: Reset data
+	nrs.Client.FlushDB()
+
+	nhs := NewHybridStorage(nrs, 4, time.Hour)
+	defer nhs.Close()
+	tb, err := nhs.Create("msf_token_bucket", 250*time.Millisecond, 10)
+	asserts.Nil(err, "Token bucket create failed")
+	remote := tb.(*hybridBucket).remote
+	start := remote.StartTime()
+
+	d, ok := tb.tryAcquire(start, 8, infinityDuration)
+	asserts.True(ok)
+	asserts.Equal(time.Duration(0), d)
+	asserts.Equal(int64(2), remote.available(start))
+
+	// The leased tokens are kept when the wait is refused.
+	asserts.Equal(int64(1), tb.acquire(start, 1))
+	_, ok = tb.tryAcquire(start, 4, 100*time.Millisecond)
+	asserts.False(ok)
+	asserts.Equal(int64(1), tb.(*hybridBucket).leased)
+
+	d, ok = tb.tryAcquire(start, 4, infinityDuration)
+	asserts.True(ok)
+	asserts.True(d > 0, fmt.Sprintf("got wait %v", d))
+	asserts.Equal(int64(0), tb.(*hybridBucket).leased)
+	fmt.Println("HybridTryAcquireTest: -> success")
+}
+
+func TestHybridLeaseExpire(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	// NOTE: Reset data
+	nrs.Client.FlushDB()
+
+	nhs := NewHybridStorage(nrs, 5, 50*time.Millisecond)
+	tb, err := nhs.Create("msf_token_bucket", time.Hour, 10)
+	asserts.Nil(err, "Token bucket create failed")
+	remote := tb.(*hybridBucket).remote
+
+	asserts.Equal(int64(1), tb.Acquire(1))
+	asserts.Equal(int64(5), remote.Available())
+	time.Sleep(100 * time.Millisecond)
+	asserts.Equal(int64(9), remote.Available(), "unused tokens are returned")
+
+	asserts.Equal(int64(1), tb.Acquire(1))
+	asserts.Nil(nhs.Close())
+	asserts.Equal(int64(8), remote.Available(), "unused tokens are returned on close")
+
+	// Once closed, the calls go straight to Redis.
+	asserts.Equal(int64(1), tb.Acquire(1))
+	asserts.Equal(int64(7), remote.Available())
+	asserts.Equal(int64(0), tb.(*hybridBucket).leased)
+	asserts.Nil(tb.(*hybridBucket).timer)
+	tb2, _ := nhs.Create("msf_token_bucket_2", time.Hour, 10)
+	asserts.True(tb2.(*hybridBucket).closed)
+	fmt.Println("HybridLeaseExpireTest: -> success")
+}
+
+func TestHybridEvict(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	// NOTE: Reset data
+	nrs.Client.FlushDB()
+
+	nhs := NewHybridStorage(nrs, 5, 50*time.Millisecond)
+	nhs.MaxEntries = 2
+	var remotes []*redisBucket
+	for i := 0; i < 3; i++ {
+		tb, err := nhs.Create(fmt.Sprintf("msf_token_bucket_:%d", i), time.Hour, 10)
+		asserts.Nil(err, "Token bucket create failed")
+		asserts.Equal(int64(1), tb.Acquire(1))
+		remotes = append(remotes, tb.(*hybridBucket).remote)
+	}
+
+	// The least recently used bucket returns its leased tokens.
+	asserts.Equal(2, len(nhs.buckets))
+	asserts.Equal(int64(9), remotes[0].Available())
+	asserts.Equal(int64(5), remotes[2].Available())
+
+	// The buckets are dropped once their lease expires.
+	time.Sleep(100 * time.Millisecond)
+	asserts.Equal(int64(9), remotes[2].Available())
+	nhs.mu.Lock()
+	asserts.Equal(0, len(nhs.buckets))
+	asserts.Equal(0, nhs.lru.Len())
+	nhs.mu.Unlock()
+	fmt.Println("HybridEvictTest: -> success")
+}
+
+func TestHybridCloseRetry(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	// NOTE: Reset data
+	nrs.Client.FlushDB()
+
+	nhs := NewHybridStorage(nrs, 5, 50*time.Millisecond)
+	tb, err := nhs.Create("msf_token_bucket", time.Hour, 10)
+	asserts.Nil(err, "Token bucket create failed")
+	hb := tb.(*hybridBucket)
+	asserts.Equal(int64(1), tb.Acquire(1))
+
+	// Redis fails while closing, the tokens are returned when the lease expires.
+	hb.remote.Client = downClient
+	asserts.True(errors.Is(nhs.Close(), ErrStorageUnavailable))
+	hb.mu.Lock()
+	asserts.NotNil(hb.timer)
+	hb.remote.Client = redisClient
+	hb.mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	asserts.Equal(int64(9), hb.remote.Available(), "unused tokens are returned later")
+	fmt.Println("HybridCloseRetryTest: -> success")
+}
+
+//------------------------------------Benchmark------------------------------------------
+func BenchmarkHybridAcquire(b *testing.B) {
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	// NOTE: Reset data
+	nrs.Client.FlushDB()
+
+	nhs := NewHybridStorage(nrs, 256, time.Second)
+	defer nhs.Close()
+	tb, _ := nhs.Create("msf_token_bucket", 1, 16*1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tb.Acquire(1)
+	}
+}
+
+func TestHybridAllow(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	// NOTE: Reset data
+	nrs.Client.FlushDB()
+
+	nhs := NewHybridStorage(nrs, 4, time.Hour)
+	defer nhs.Close()
+	tb, err := nhs.Create("msf_token_bucket", time.Second, 10)
+	asserts.Nil(err, "Token bucket create failed")
+	remote := tb.(*hybridBucket).remote
+	start := remote.StartTime()
+
+	// The leased tokens are decided in the process.
+	asserts.Equal(Decision{Allowed: true, Granted: 1, Remaining: 3, Limit: 10}, tb.allow(start, 1))
+	asserts.Equal(Decision{Allowed: true, Granted: 3, Remaining: 0, Limit: 10}, tb.allow(start, 3))
+	asserts.Equal(int64(6), remote.available(start))
+
+	// Redis decides when the lease falls short.
+	asserts.Equal(Decision{Allowed: true, Granted: 6, Remaining: 0, Limit: 10}, tb.allow(start, 6))
+	asserts.Equal(Decision{Limit: 10, ResetAfter: 10 * time.Second, RetryAfter: 2 * time.Second}, tb.allow(start, 2))
+	fmt.Println("HybridAllowTest: -> success")
+}
+
+func TestHybridFailure(t *testing.T) {
+	asserts := assert.New(t)
+
+	var failures int
+	nrs := NewRedisStorage(downClient, bucketExpire)
+	nrs.OnFailure = func(key string, policy FailurePolicy, err error) {
+		failures++
+	}
+	nhs := NewHybridStorage(nrs, 4, time.Hour)
+	tb, err := nhs.Create("msf_token_bucket", time.Second, 3)
+	asserts.Nil(err, "Token bucket create failed")
+	failures = 0
+
+	// A failed lease applies the policy, Redis is not called a second time.
+	for _, policy := range []FailurePolicy{FailOpen, FailClosed, FailLocal} {
+		nrs.Policy = policy
+		about := fmt.Sprint(policy)
+		now := time.Now()
+		_, err := tb.acquireE(now, 1)
+		asserts.Equal(policy == FailClosed, errors.Is(err, ErrStorageUnavailable), about)
+		_, err = tb.tryAcquireE(now, 1, infinityDuration)
+		asserts.Equal(policy == FailClosed, errors.Is(err, ErrStorageUnavailable), about)
+		d, err := tb.allowE(now, 1)
+		asserts.Equal(policy == FailClosed, errors.Is(err, ErrStorageUnavailable), about)
+		asserts.Equal(policy != FailClosed, d.Allowed, about)
+		asserts.Equal(3, failures, about)
+		failures = 0
+		fmt.Println("HybridFailureTest:", policy, "-> success")
+	}
+}
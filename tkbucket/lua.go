@@ -1,15 +1,213 @@
 package tkbucket
 
+import (
+	"github.com/go-redis/redis"
+)
+
+var (
+	scriptAcquire    = redis.NewScript(luaAcquire)
+	scriptAvailable  = redis.NewScript(luaAvailable)
+	scriptTryAcquire = redis.NewScript(luaTryAcquire)
+	scriptRefund     = redis.NewScript(luaRefund)
+	scriptLease      = redis.NewScript(luaLease)
+	scriptAllow      = redis.NewScript(luaAllow)
+	scriptCreate     = redis.NewScript(luaCreate)
+
+	scriptMultiTryAcquire = redis.NewScript(luaMultiTryAcquire)
+
+	scriptGCRAAcquire    = redis.NewScript(luaGCRAAcquire)
+	scriptGCRAAvailable  = redis.NewScript(luaGCRAAvailable)
+	scriptGCRATryAcquire = redis.NewScript(luaGCRATryAcquire)
+	scriptGCRARefund     = redis.NewScript(luaGCRARefund)
+	scriptGCRAAllow      = redis.NewScript(luaGCRAAllow)
+
+	scriptLogAcquire    = redis.NewScript(luaLogAcquire)
+	scriptLogAvailable  = redis.NewScript(luaLogAvailable)
+	scriptLogTryAcquire = redis.NewScript(luaLogTryAcquire)
+	scriptLogRefund     = redis.NewScript(luaLogRefund)
+	scriptLogAllow      = redis.NewScript(luaLogAllow)
+
+	scriptCounterAcquire    = redis.NewScript(luaCounterAcquire)
+	scriptCounterAvailable  = redis.NewScript(luaCounterAvailable)
+	scriptCounterTryAcquire = redis.NewScript(luaCounterTryAcquire)
+	scriptCounterRefund     = redis.NewScript(luaCounterRefund)
+	scriptCounterAllow      = redis.NewScript(luaCounterAllow)
+
+	scriptQuotaAcquire = redis.NewScript(luaQuotaAcquire)
+
+	scriptPermitAcquire  = redis.NewScript(luaPermitAcquire)
+	scriptPermitRenew    = redis.NewScript(luaPermitRenew)
+	scriptPermitInFlight = redis.NewScript(luaPermitInFlight)
+
+	// scripts holds all the scripts to preload.
+	scripts = []*redis.Script{
+		scriptAcquire,
+		scriptAvailable,
+		scriptTryAcquire,
+		scriptRefund,
+		scriptLease,
+		scriptAllow,
+		scriptCreate,
+		scriptMultiTryAcquire,
+		scriptGCRAAcquire,
+		scriptGCRAAvailable,
+		scriptGCRATryAcquire,
+		scriptGCRARefund,
+		scriptGCRAAllow,
+		scriptLogAcquire,
+		scriptLogAvailable,
+		scriptLogTryAcquire,
+		scriptLogRefund,
+		scriptLogAllow,
+		scriptCounterAcquire,
+		scriptCounterAvailable,
+		scriptCounterTryAcquire,
+		scriptCounterRefund,
+		scriptCounterAllow,
+		scriptQuotaAcquire,
+		scriptPermitAcquire,
+		scriptPermitRenew,
+		scriptPermitInFlight,
+	}
+
+	// algorithmScripts holds the scripts of the buckets of each Algorithm.
+	algorithmScripts = map[Algorithm]*redisScripts{
+		TokenBucket:          {scriptAcquire, scriptTryAcquire, scriptAvailable, scriptRefund, scriptAllow},
+		GCRA:                 {scriptGCRAAcquire, scriptGCRATryAcquire, scriptGCRAAvailable, scriptGCRARefund, scriptGCRAAllow},
+		SlidingWindowLog:     {scriptLogAcquire, scriptLogTryAcquire, scriptLogAvailable, scriptLogRefund, scriptLogAllow},
+		SlidingWindowCounter: {scriptCounterAcquire, scriptCounterTryAcquire, scriptCounterAvailable, scriptCounterRefund, scriptCounterAllow},
+	}
+)
+
+// redisScripts holds the scripts implementing the methods of a redisBucket.
+type redisScripts struct {
+	acquire    *redis.Script
+	tryAcquire *redis.Script
+	available  *redis.Script
+	refund     *redis.Script
+	allow      *redis.Script
+}
+
+// With RedisStorage.ServerTime, the time arguments of the scripts are
+// empty, and the scripts read the clock of Redis instead, so that all the
+// clients agree on the time whatever the skew of their clocks.
+const luaServerTimeFuc = `
+		-- serverTime returns the seconds and the microseconds of the clock of Redis,
+		-- the microseconds padded to 6 digits
+		local serverTime = function()
+			-- TIME is not deterministic, replicate the effects of the script instead
+			redis.replicate_commands()
+			local t = redis.call("time")
+			return t[1], string.format("%06d", tonumber(t[2]))
+		end
+	`
+
+// All the scripts take the same leading arguments, so that they can
+// create the bucket on first use:
+//
+//	KEYS[1]  the key of the bucket
+//	ARGV[1]  the current time in nanoseconds
+//	ARGV[2]  fill_interval in nanoseconds
+//	ARGV[3]  capacity
+//	ARGV[4]  quantum
+//	ARGV[5]  the TTL of the key in milliseconds, refreshed by every script, 0 for none,
+//	         or < 0 for the time it takes to refill the bucket plus the negated margin
+//	ARGV[6]  "1" if the bucket refills continuously, a token at a time, "0" otherwise
+//
+// followed by the arguments of each script.
 const (
-	luaCommonFuc = `
-		local currentTick = function(nowTime, startTime, fillInterval) 
-			-- current time tick, measured from startTime
-			-- +500 to reduce accuracy error
-			return math.floor((nowTime - startTime + 500) / fillInterval)
+	luaCommonFuc = luaServerTimeFuc + `
+		if ARGV[1] == ""
+		then
+			local sec, usec = serverTime()
+			ARGV[1] = sec .. usec .. "000"
 		end
 
-		local adjustAvail = function(tick, avail, capacity, latestTick, quantum)
-			if avail > capacity
+		-- floorDiv returns a / b rounded down, exact for integers
+		local floorDiv = function(a, b)
+			local q = math.floor(a / b)
+			local r = a - q * b
+			if r < 0
+			then
+				q = q - 1
+			elseif r >= b
+			then
+				q = q + 1
+			end
+			return q
+		end
+
+		-- splitTime splits a time in nanoseconds, a string too large
+		-- to be exact in a Lua number, in seconds and nanoseconds
+		local splitTime = function(s)
+			local n = string.len(s)
+			if n <= 9
+			then
+				return 0, tonumber(s)
+			end
+			return tonumber(string.sub(s, 1, n - 9)), tonumber(string.sub(s, n - 8))
+		end
+
+		-- mulDiv returns a * b / c truncated toward zero and the remainder,
+		-- a being a string of digits. It divides digit by digit, exact while
+		-- b and c are below 10^14.
+		local mulDiv = function(a, b, c)
+			local q, r = 0, 0
+			for i = 1, string.len(a)
+			do
+				r = r * 10 + tonumber(string.sub(a, i, i)) * b
+				local digit = floorDiv(r, c)
+				q = q * 10 + digit
+				r = r - digit * c
+			end
+			return q, r
+		end
+
+		-- currentTick returns the current time tick, measured from startTime and
+		-- truncated toward zero like the memory bucket, and the remainder of the
+		-- division. A tick of a continuous bucket is the arrival of a token,
+		-- quantum ticks every fillInterval.
+		local currentTick = function(nowTime, startTime, fillInterval, quantum, continuous)
+			local nowSec, nowNs = splitTime(nowTime)
+			local startSec, startNs = splitTime(startTime)
+			local sec, ns = nowSec - startSec, nowNs - startNs
+			local sign = 1
+			if sec < 0 or (sec == 0 and ns < 0)
+			then
+				sign, sec, ns = -1, -sec, -ns
+			end
+			if ns < 0
+			then
+				sec, ns = sec - 1, ns + 1000000000
+			end
+
+			local mul = 1
+			if continuous
+			then
+				mul = quantum
+			end
+			local tick, rem = mulDiv(string.format("%d%09d", sec, ns), mul, fillInterval)
+			return sign * tick, sign * rem
+		end
+
+		-- waitTime returns how long to wait for the missing tokens,
+		-- rem being the remainder of currentTick
+		local waitTime = function(missing, quantum, fillInterval, rem, continuous)
+			if continuous
+			then
+				local n, r = mulDiv(string.format("%d", missing), fillInterval, quantum)
+				return n + floorDiv(r - rem + quantum - 1, quantum)
+			end
+			return floorDiv(missing + quantum - 1, quantum) * fillInterval - rem
+		end
+
+		local adjustAvail = function(tick, avail, capacity, latestTick, quantum, continuous)
+			if continuous
+			then
+				-- Each tick adds a token
+				quantum = 1
+			end
+			if avail >= capacity
 			then
 				return avail, tick
 			end
@@ -22,95 +220,983 @@ const (
 
 			return avail, tick
 		end
-	`
 
-	luaAcquire = luaCommonFuc + `
-		local key = KEYS[1]
-		local nowTime = tonumber(ARGV[1])
-		local count = tonumber(ARGV[2])
-		local bulk = redis.call("hmget", key, "start_time", "fill_interval", "capacity", "quantum", "avail", "latest_tick")
-		if bulk ~= nil then
-			local startTime = tonumber(bulk[1])
-			local fillInterval = tonumber(bulk[2])
-			local capacity = tonumber(bulk[3])
-			local quantum = tonumber(bulk[4])
-			local avail = tonumber(bulk[5])
-			local latestTick = tonumber(bulk[6])
+		-- buckets holds the parameters of the buckets loaded by the script, by key
+		local buckets = {}
 
-			local tick = currentTick(nowTime, startTime, fillInterval)
-			avail, latestTick = adjustAvail(tick, avail, capacity, latestTick, quantum)
-			if avail <= 0 
+		-- expireBucket sets the TTL of the bucket holding avail tokens, if it depends
+		-- on the tokens: the time it takes to refill the bucket plus the margin, so
+		-- that a bucket in debt does not expire before the booked tokens are refilled.
+		local expireBucket = function(key, avail)
+			local b = buckets[key]
+			if b.expire >= 0
 			then
-				return 0
+				return
 			end
 
-			if count > avail 
+			local ttl = -b.expire
+			if avail < b.capacity
+			then
+				local _, rem = currentTick(ARGV[1], b.startTime, b.fillInterval, b.quantum, b.continuous)
+				ttl = ttl + math.ceil(waitTime(b.capacity - avail, b.quantum, b.fillInterval, rem, b.continuous) / 1000000)
+			end
+			-- The longest time.Duration, the bucket takes forever to refill
+			if ttl > 9223372036854
 			then
-				count = avail
+				redis.call("persist", key)
+				return
 			end
+			redis.call("pexpire", key, ttl)
+		end
 
-			avail = avail - count
-			-- Update bucket data
-			redis.call("hmset", key, "avail", avail, "latest_tick", latestTick)
+		-- loadBucketArgs reads the bucket, or creates it full from the arguments
+		-- if it does not exist, e.g. it has expired, and refreshes its TTL.
+		-- A TTL depending on the tokens is refreshed by saveBucket instead.
+		-- The last result tells whether the bucket has been created.
+		local loadBucketArgs = function(key, nowTime, fillInterval, capacity, quantum, expire, continuous)
+			local bulk = redis.call("hmget", key, "start_time", "fill_interval", "capacity", "quantum", "avail", "latest_tick",
+				"continuous")
+			local created = false
+			-- hmget returns false for the fields of a missing key
+			if not bulk[1]
+			then
+				-- Strings are stored as is, numbers may be formatted in exponent notation
+				redis.call("hmset", key, "start_time", nowTime, "fill_interval", fillInterval, "capacity", capacity,
+					"quantum", quantum, "avail", capacity, "latest_tick", 0, "continuous", continuous)
+				bulk = {nowTime, fillInterval, capacity, quantum, capacity, 0, continuous}
+				created = true
+			end
+			buckets[key] = {startTime = bulk[1], fillInterval = tonumber(bulk[2]), capacity = tonumber(bulk[3]),
+				quantum = tonumber(bulk[4]), continuous = bulk[7] == "1", expire = tonumber(expire)}
+			if buckets[key].expire > 0
+			then
+				redis.call("pexpire", key, expire)
+			elseif created
+			then
+				expireBucket(key, buckets[key].capacity)
+			end
+
+			-- The start time is kept as a string, see currentTick. The buckets
+			-- stored without the continuous field refill by ticks.
+			return bulk[1], tonumber(bulk[2]), tonumber(bulk[3]), tonumber(bulk[4]),
+				tonumber(bulk[5]), tonumber(bulk[6]), bulk[7] == "1", created
+		end
+
+		-- saveBucket stores the tokens of the bucket, formatted as integers
+		-- rather than in exponent notation
+		local saveBucket = function(key, avail, latestTick)
+			redis.call("hmset", key, "avail", string.format("%d", avail), "latest_tick", string.format("%d", latestTick))
+			expireBucket(key, avail)
+		end
+
+		-- loadBucket is loadBucketArgs with the leading arguments of the script.
+		local loadBucket = function(key)
+			return loadBucketArgs(key, ARGV[1], ARGV[2], ARGV[3], ARGV[4], ARGV[5], ARGV[6])
+		end
+	`
 
-			return count
+	luaAcquire = luaCommonFuc + `
+		local key = KEYS[1]
+		local count = tonumber(ARGV[7])
+		local startTime, fillInterval, capacity, quantum, avail, latestTick, continuous = loadBucket(key)
+
+		local tick = currentTick(ARGV[1], startTime, fillInterval, quantum, continuous)
+		avail, latestTick = adjustAvail(tick, avail, capacity, latestTick, quantum, continuous)
+		if avail <= 0 
+		then
+			return 0
+		end
+
+		if count > avail 
+		then
+			count = avail
 		end
 
-  		return nil
+		avail = avail - count
+		-- Update bucket data
+		saveBucket(key, avail, latestTick)
+
+		return count
 	`
 
 	luaAvailable = luaCommonFuc + `
 		local key = KEYS[1]
-		local nowTime = tonumber(ARGV[1])
-		local bulk = redis.call("hmget", key, "start_time", "fill_interval", "capacity", "quantum", "avail", "latest_tick")
-		if bulk ~= nil then
-			local startTime = tonumber(bulk[1])
-			local fillInterval = tonumber(bulk[2])
-			local capacity = tonumber(bulk[3])
-			local quantum = tonumber(bulk[4])
-			local avail = tonumber(bulk[5])
-			local latestTick = tonumber(bulk[6])
-
-			local tick = currentTick(nowTime, startTime, fillInterval)
-			avail, latestTick = adjustAvail(tick, avail, capacity, latestTick, quantum)
+		local startTime, fillInterval, capacity, quantum, avail, latestTick, continuous = loadBucket(key)
+
+		local tick = currentTick(ARGV[1], startTime, fillInterval, quantum, continuous)
+		avail, latestTick = adjustAvail(tick, avail, capacity, latestTick, quantum, continuous)
+		-- Update bucket data
+		saveBucket(key, avail, latestTick)
+
+		return avail
+	`
+
+	luaTryAcquire = luaCommonFuc + `
+		local key = KEYS[1]
+		local count = tonumber(ARGV[7])
+		local maxWait = tonumber(ARGV[8])
+		local startTime, fillInterval, capacity, quantum, avail, latestTick, continuous = loadBucket(key)
+
+		local tick, rem = currentTick(ARGV[1], startTime, fillInterval, quantum, continuous)
+		avail, latestTick = adjustAvail(tick, avail, capacity, latestTick, quantum, continuous)
+		avail = avail - count
+		if avail >= 0
+		then
 			-- Update bucket data
-			redis.call("hmset", key, "avail", avail, "latest_tick", latestTick)
+			saveBucket(key, avail, latestTick)
+			return 0
+		end
 
-			return avail
+		local wait = waitTime(-avail, quantum, fillInterval, rem, continuous)
+		if wait > maxWait
+		then
+			-- Refuse without taking any token
+			return -1
 		end
 
-  		return nil
+		-- Update bucket data
+		saveBucket(key, avail, latestTick)
+		return wait
 	`
 
-	luaTryAcquire = luaCommonFuc + `
+	luaRefund = luaCommonFuc + `
 		local key = KEYS[1]
-		local nowTime = tonumber(ARGV[1])
+		local count = tonumber(ARGV[7])
+		local startTime, fillInterval, capacity, quantum, avail, latestTick, continuous = loadBucket(key)
+
+		local tick = currentTick(ARGV[1], startTime, fillInterval, quantum, continuous)
+		avail, latestTick = adjustAvail(tick, avail, capacity, latestTick, quantum, continuous)
+		avail = avail + count
+		if avail > capacity
+		then
+			avail = capacity
+		end
+		-- Update bucket data
+		saveBucket(key, avail, latestTick)
+
+		return avail
+	`
+
+	luaLease = luaCommonFuc + `
+		local key = KEYS[1]
+		local need = tonumber(ARGV[7])
+		local want = tonumber(ARGV[8])
+		local startTime, fillInterval, capacity, quantum, avail, latestTick, continuous = loadBucket(key)
+
+		local tick = currentTick(ARGV[1], startTime, fillInterval, quantum, continuous)
+		avail, latestTick = adjustAvail(tick, avail, capacity, latestTick, quantum, continuous)
+		-- Lease all the needed tokens or nothing
+		if avail < need
+		then
+			return 0
+		end
+
+		if want > avail
+		then
+			want = avail
+		end
+
+		avail = avail - want
+		-- Update bucket data
+		saveBucket(key, avail, latestTick)
+
+		return want
+	`
+
+	// luaAllow takes count tokens if they are all available, and returns
+	// the decision: allowed, granted, remaining, limit, reset after and
+	// retry after, -1 if the tokens exceed the capacity.
+	luaAllow = luaCommonFuc + `
+		local key = KEYS[1]
+		local count = tonumber(ARGV[7])
+		local startTime, fillInterval, capacity, quantum, avail, latestTick, continuous = loadBucket(key)
+
+		local tick, rem = currentTick(ARGV[1], startTime, fillInterval, quantum, continuous)
+		avail, latestTick = adjustAvail(tick, avail, capacity, latestTick, quantum, continuous)
+		local allowed, granted, retryAfter = 0, 0, 0
+		if count <= math.max(avail, 0)
+		then
+			allowed, granted = 1, math.max(count, 0)
+			avail = avail - granted
+		elseif count > capacity
+		then
+			-- The tokens never fit in the bucket
+			retryAfter = -1
+		else
+			retryAfter = waitTime(count - avail, quantum, fillInterval, rem, continuous)
+		end
+		-- Update bucket data
+		saveBucket(key, avail, latestTick)
+
+		local resetAfter = 0
+		if avail < capacity
+		then
+			resetAfter = waitTime(capacity - avail, quantum, fillInterval, rem, continuous)
+		end
+		return {allowed, granted, math.max(avail, 0), capacity, resetAfter, retryAfter}
+	`
+
+	luaCreate = luaCommonFuc + `
+		local key = KEYS[1]
+		local fillInterval = tonumber(ARGV[2])
+		local capacity = tonumber(ARGV[3])
+		local quantum = tonumber(ARGV[4])
+		local continuous = ARGV[6] == "1"
+		local update = ARGV[7] == "1"
+		local oldStartTime, oldFillInterval, oldCapacity, oldQuantum, avail, latestTick, oldContinuous, created = loadBucket(key)
+		if created
+		then
+			return 0
+		end
+		if oldFillInterval == fillInterval and oldCapacity == capacity and oldQuantum == quantum
+			and oldContinuous == continuous
+		then
+			return 1
+		end
+		if not update
+		then
+			return -1
+		end
+
+		-- Keep the tokens of the bucket up to the new capacity
+		local tick = currentTick(ARGV[1], oldStartTime, oldFillInterval, oldQuantum, oldContinuous)
+		avail, latestTick = adjustAvail(tick, avail, oldCapacity, latestTick, oldQuantum, oldContinuous)
+		if avail > capacity
+		then
+			avail = capacity
+		end
+		redis.call("hmset", key, "start_time", ARGV[1], "fill_interval", ARGV[2], "capacity", ARGV[3],
+			"quantum", ARGV[4], "avail", string.format("%d", avail), "latest_tick", 0, "continuous", ARGV[6])
+		buckets[key] = {startTime = ARGV[1], fillInterval = fillInterval, capacity = capacity,
+			quantum = quantum, continuous = continuous, expire = buckets[key].expire}
+		expireBucket(key, avail)
+
+		return 2
+	`
+
+	// luaMultiTryAcquire takes count tokens from all the buckets or none.
+	// It takes the current time followed by count and maxWait, then the
+	// parameters of each bucket, ARGV[2] to ARGV[6] of the other scripts.
+	// It returns the longest wait, or -1 if a bucket refuses.
+	luaMultiTryAcquire = luaCommonFuc + `
 		local count = tonumber(ARGV[2])
-		local bulk = redis.call("hmget", key, "start_time", "fill_interval", "capacity", "quantum", "avail", "latest_tick")
-		if bulk ~= nil then
-			local startTime = tonumber(bulk[1])
-			local fillInterval = tonumber(bulk[2])
-			local capacity = tonumber(bulk[3])
-			local quantum = tonumber(bulk[4])
-			local avail = tonumber(bulk[5])
-			local latestTick = tonumber(bulk[6])
-
-			local tick = currentTick(nowTime, startTime, fillInterval)
-			avail, latestTick = adjustAvail(tick, avail, capacity, latestTick, quantum)
+		local maxWait = tonumber(ARGV[3])
+		local wait = 0
+		local updates = {}
+
+		for i, key in ipairs(KEYS)
+		do
+			local j = 5 * i - 1
+			local startTime, fillInterval, capacity, quantum, avail, latestTick, continuous =
+				loadBucketArgs(key, ARGV[1], ARGV[j], ARGV[j + 1], ARGV[j + 2], ARGV[j + 3], ARGV[j + 4])
+
+			local tick, rem = currentTick(ARGV[1], startTime, fillInterval, quantum, continuous)
+			avail, latestTick = adjustAvail(tick, avail, capacity, latestTick, quantum, continuous)
 			avail = avail - count
-			-- Update bucket data
-			redis.call("hmset", key, "avail", avail, "latest_tick", latestTick)
-			if avail >= 0
+			if avail < 0
+			then
+				local d = waitTime(-avail, quantum, fillInterval, rem, continuous)
+				if d > maxWait
+				then
+					-- Refuse without taking any token
+					return -1
+				end
+				if d > wait
+				then
+					wait = d
+				end
+			end
+			updates[i] = {avail, latestTick}
+		end
+
+		-- Update bucket data
+		for i, key in ipairs(KEYS)
+		do
+			saveBucket(key, updates[i][1], updates[i][2])
+		end
+		return wait
+	`
+)
+
+// The GCRA scripts store the TAT of the bucket as a string of nanoseconds,
+// which is too large to be exact in a Lua number. It is split in seconds
+// and nanoseconds, so that the differences with the current time are exact.
+//
+//	KEYS[1]  the key of the bucket
+//	ARGV[1]  the current time in nanoseconds
+//	ARGV[2]  the emission interval in nanoseconds
+//	ARGV[3]  tau, the time it takes to refill the empty bucket, in nanoseconds
+//
+// followed by the arguments of each script. The key expires with the TAT,
+// when the bucket is full again.
+const (
+	luaGCRACommonFuc = luaServerTimeFuc + `
+		if ARGV[1] == ""
+		then
+			local sec, usec = serverTime()
+			ARGV[1] = sec .. usec .. "000"
+		end
+
+		local toTime = function(s)
+			local n = string.len(s)
+			if n <= 9
+			then
+				return {0, tonumber(s)}
+			end
+			return {tonumber(string.sub(s, 1, n - 9)), tonumber(string.sub(s, n - 8))}
+		end
+
+		-- sub returns a - b in nanoseconds
+		local sub = function(a, b)
+			return (a[1] - b[1]) * 1000000000 + (a[2] - b[2])
+		end
+
+		-- floorDiv returns a / b rounded down, exact for integers
+		local floorDiv = function(a, b)
+			local q = math.floor(a / b)
+			local r = a - q * b
+			if r < 0
+			then
+				q = q - 1
+			elseif r >= b
+			then
+				q = q + 1
+			end
+			return q
+		end
+
+		-- add returns t + d nanoseconds
+		local add = function(t, d)
+			local ns = t[2] + d
+			local s = floorDiv(ns, 1000000000)
+			return {t[1] + s, ns - s * 1000000000}
+		end
+
+		local interval = tonumber(ARGV[2])
+		local tau = tonumber(ARGV[3])
+		local now = toTime(ARGV[1])
+
+		-- loadTat returns the TAT of the bucket, not before now
+		local loadTat = function(key)
+			local v = redis.call("get", key)
+			if not v
+			then
+				return now
+			end
+			local tat = toTime(v)
+			if sub(tat, now) < 0
+			then
+				return now
+			end
+			return tat
+		end
+
+		-- storeTat saves the TAT of the bucket until it is full again
+		local storeTat = function(key, tat)
+			local ttl = sub(tat, now)
+			if ttl <= 0
+			then
+				redis.call("del", key)
+				return
+			end
+			local v = string.format("%d%09d", tat[1], tat[2])
+			if tat[1] == 0
+			then
+				v = string.format("%d", tat[2])
+			end
+			redis.call("set", key, v, "px", math.ceil(ttl / 1000000))
+		end
+	`
+
+	luaGCRAAcquire = luaGCRACommonFuc + `
+		local key = KEYS[1]
+		local count = tonumber(ARGV[4])
+		local tat = loadTat(key)
+
+		local avail = floorDiv(tau - sub(tat, now), interval)
+		if avail <= 0
+		then
+			return 0
+		end
+
+		if count > avail
+		then
+			count = avail
+		end
+		storeTat(key, add(tat, count * interval))
+
+		return count
+	`
+
+	luaGCRAAvailable = luaGCRACommonFuc + `
+		local tat = loadTat(KEYS[1])
+
+		return floorDiv(tau - sub(tat, now), interval)
+	`
+
+	luaGCRATryAcquire = luaGCRACommonFuc + `
+		local key = KEYS[1]
+		local count = tonumber(ARGV[4])
+		local maxWait = tonumber(ARGV[5])
+		local tat = add(loadTat(key), count * interval)
+
+		-- The request conforms once the new TAT is within tau of now
+		local wait = sub(tat, now) - tau
+		if wait < 0
+		then
+			wait = 0
+		end
+		if wait > maxWait
+		then
+			-- Refuse without taking any token
+			return -1
+		end
+		storeTat(key, tat)
+
+		return wait
+	`
+
+	luaGCRAAllow = luaGCRACommonFuc + `
+		local key = KEYS[1]
+		local count = tonumber(ARGV[4])
+		local capacity = tau / interval
+		local tat = loadTat(key)
+
+		local avail = floorDiv(tau - sub(tat, now), interval)
+		local allowed, granted, retryAfter = 0, 0, 0
+		if count <= math.max(avail, 0)
+		then
+			allowed, granted = 1, math.max(count, 0)
+			if granted > 0
+			then
+				tat = add(tat, granted * interval)
+				storeTat(key, tat)
+				avail = avail - granted
+			end
+		elseif count > capacity
+		then
+			-- The tokens never fit in the bucket
+			retryAfter = -1
+		else
+			-- The request conforms once the new TAT is within tau of now
+			retryAfter = sub(tat, now) + count * interval - tau
+		end
+
+		return {allowed, granted, math.max(avail, 0), capacity, sub(tat, now), retryAfter}
+	`
+
+	luaGCRARefund = luaGCRACommonFuc + `
+		local key = KEYS[1]
+		local count = tonumber(ARGV[4])
+		local tat = add(loadTat(key), -count * interval)
+		-- The TAT never goes before now, the bucket is full then
+		storeTat(key, tat)
+
+		return 0
+	`
+)
+
+// The sliding window log is a sorted set of the tokens taken, a member
+// "time:count" per time in microseconds, which is exact in a Lua number.
+//
+//	KEYS[1]  the key of the bucket
+//	ARGV[1]  the current time in microseconds
+//	ARGV[2]  the window in microseconds
+//	ARGV[3]  capacity
+//
+// followed by the arguments of each script. The key expires when the
+// latest tokens leave the window.
+const (
+	luaLogCommonFuc = luaServerTimeFuc + `
+		if ARGV[1] == ""
+		then
+			local sec, usec = serverTime()
+			ARGV[1] = sec .. usec
+		end
+
+		local now = tonumber(ARGV[1])
+		local window = tonumber(ARGV[2])
+		local capacity = tonumber(ARGV[3])
+
+		local member = function(t, count)
+			return string.format("%d:%d", t, count)
+		end
+
+		-- loadLog removes the tokens which left the window, and returns
+		-- the times and counts of the log, the oldest first, and their sum
+		local loadLog = function(key)
+			redis.call("zremrangebyscore", key, "-inf", now - window)
+			local members = redis.call("zrange", key, 0, -1)
+			local times, counts, used = {}, {}, 0
+			for i, m in ipairs(members)
+			do
+				local sep = string.find(m, ":")
+				times[i] = tonumber(string.sub(m, 1, sep - 1))
+				counts[i] = tonumber(string.sub(m, sep + 1))
+				used = used + counts[i]
+			end
+			return times, counts, used
+		end
+
+		-- record logs count tokens at t, with the entry of t if there is one,
+		-- before the tokens reserved after t
+		local record = function(key, times, counts, t, count)
+			local latest = t
+			for i = 1, #times
+			do
+				if times[i] == t
+				then
+					redis.call("zrem", key, member(times[i], counts[i]))
+					count = counts[i] + count
+				end
+				latest = math.max(latest, times[i])
+			end
+			redis.call("zadd", key, t, member(t, count))
+			redis.call("pexpire", key, math.ceil((latest + window - now) / 1000))
+		end
+
+		-- availableAt returns when count more tokens fit in the window, now
+		-- or the time enough of the oldest tokens leave it
+		local availableAt = function(times, counts, used, count)
+			local at = now
+			local need = used + count - capacity
+			local freed = 0
+			for i = 1, #times
+			do
+				if freed >= need
+				then
+					break
+				end
+				freed = freed + counts[i]
+				at = times[i] + window
+			end
+			return at
+		end
+	`
+
+	luaLogAcquire = luaLogCommonFuc + `
+		local key = KEYS[1]
+		local count = tonumber(ARGV[4])
+		local times, counts, used = loadLog(key)
+
+		local avail = capacity - used
+		if avail <= 0
+		then
+			return 0
+		end
+
+		if count > avail
+		then
+			count = avail
+		end
+		record(key, times, counts, now, count)
+
+		return count
+	`
+
+	luaLogAvailable = luaLogCommonFuc + `
+		local times, counts, used = loadLog(KEYS[1])
+
+		return capacity - used
+	`
+
+	luaLogTryAcquire = luaLogCommonFuc + `
+		local key = KEYS[1]
+		local count = tonumber(ARGV[4])
+		local maxWait = tonumber(ARGV[5])
+		if count > capacity
+		then
+			-- The tokens never fit in the window
+			return -1
+		end
+		local times, counts, used = loadLog(key)
+
+		-- Wait until enough of the oldest tokens leave the window
+		local at = availableAt(times, counts, used, count)
+		if at - now > maxWait
+		then
+			-- Refuse without taking any token
+			return -1
+		end
+		record(key, times, counts, at, count)
+
+		return at - now
+	`
+
+	luaLogAllow = luaLogCommonFuc + `
+		local key = KEYS[1]
+		local count = tonumber(ARGV[4])
+		local times, counts, used = loadLog(key)
+
+		local allowed, granted, retryAfter = 0, 0, 0
+		if count <= math.max(capacity - used, 0)
+		then
+			allowed, granted = 1, math.max(count, 0)
+			if granted > 0
+			then
+				record(key, times, counts, now, granted)
+				used = used + granted
+			end
+		elseif count > capacity
+		then
+			-- The tokens never fit in the window
+			retryAfter = -1
+		else
+			retryAfter = availableAt(times, counts, used, count) - now
+		end
+
+		-- The bucket is full again when the latest tokens leave the window
+		local latest = times[#times]
+		if granted > 0 and (not latest or latest < now)
+		then
+			latest = now
+		end
+		local resetAfter = 0
+		if latest
+		then
+			resetAfter = latest + window - now
+		end
+		return {allowed, granted, math.max(capacity - used, 0), capacity, resetAfter, retryAfter}
+	`
+
+	// luaLogRefund takes count, and the delay from now until the time
+	// the tokens are available at, in microseconds.
+	luaLogRefund = luaLogCommonFuc + `
+		local key = KEYS[1]
+		local count = tonumber(ARGV[4])
+		local at = now + tonumber(ARGV[5])
+		local times, counts = loadLog(key)
+
+		-- Remove the tokens from the entry they are logged with, the closest to at
+		local closest, distance = 0, 0
+		for i = 1, #times
+		do
+			local d = math.abs(times[i] - at)
+			if closest == 0 or d < distance
+			then
+				closest, distance = i, d
+			end
+		end
+		if closest == 0 or count <= 0
+		then
+			return 0
+		end
+
+		redis.call("zrem", key, member(times[closest], counts[closest]))
+		if counts[closest] > count
+		then
+			redis.call("zadd", key, times[closest], member(times[closest], counts[closest] - count))
+		end
+
+		return 0
+	`
+)
+
+// The sliding window counter is a hash of the tokens taken in the fixed
+// windows, by index. The windows are aligned on the unix epoch, their index
+// and the time elapsed in the current one are computed by the caller.
+//
+//	KEYS[1]  the key of the bucket
+//	ARGV[1]  the index of the current window
+//	ARGV[2]  the time elapsed in the current window in nanoseconds
+//	ARGV[3]  the window in nanoseconds
+//	ARGV[4]  capacity
+//
+// followed by the arguments of each script. The key expires when the
+// latest window it counts is not the previous one anymore.
+const (
+	luaCounterCommonFuc = luaServerTimeFuc + `
+		if ARGV[1] == ""
+		then
+			-- Divide the time in nanoseconds digit by digit, exact
+			-- for the windows shorter than 10 days
+			local sec, usec = serverTime()
+			local t = sec .. usec .. "000"
+			local window = tonumber(ARGV[3])
+			local q, r = 0, 0
+			for i = 1, string.len(t)
+			do
+				r = r * 10 + tonumber(string.sub(t, i, i))
+				local digit = math.floor(r / window)
+				q = q * 10 + digit
+				r = r - digit * window
+			end
+			ARGV[1], ARGV[2] = q, r
+		end
+
+		local idx = tonumber(ARGV[1])
+		local elapsed = tonumber(ARGV[2])
+		local window = tonumber(ARGV[3])
+		local capacity = tonumber(ARGV[4])
+
+		-- loadCounts forgets the windows before the previous one,
+		-- and returns the counters indexed from the previous window,
+		-- so that the table stays small
+		local loadCounts = function(key)
+			local bulk = redis.call("hgetall", key)
+			local counts = {}
+			for i = 1, #bulk, 2
+			do
+				local w = tonumber(bulk[i])
+				if w < idx - 1
+				then
+					redis.call("hdel", key, bulk[i])
+				else
+					counts[w - idx + 2] = tonumber(bulk[i + 1])
+				end
+			end
+			return counts
+		end
+
+		local get = function(counts, w)
+			return counts[w - idx + 2] or 0
+		end
+
+		-- add counts count tokens in the window w
+		local add = function(key, counts, w, count)
+			counts[w - idx + 2] = get(counts, w) + count
+			redis.call("hincrby", key, string.format("%d", w), count)
+			local ttl = math.ceil(((w - idx + 2) * window - elapsed) / 1000000)
+			if ttl > redis.call("pttl", key)
+			then
+				redis.call("pexpire", key, ttl)
+			end
+		end
+
+		-- avail returns the tokens left, the previous window weighted
+		-- by how much it overlaps the rolling window
+		local avail = function(counts)
+			return math.floor((capacity - get(counts, idx)) - get(counts, idx - 1) * (window - elapsed) / window)
+		end
+
+		-- find returns the first window from idx where count more tokens fit,
+		-- and how long to wait for them. There is always one after the windows
+		-- holding reserved tokens, count must not exceed the capacity.
+		local find = function(counts, count)
+			local w = idx
+			while true
+			do
+				local room = capacity - get(counts, w) - count
+				if room >= 0
+				then
+					-- start is the time elapsed in the window w when the
+					-- weight of the previous window is low enough
+					local start = 0
+					local prev = get(counts, w - 1)
+					if prev > 0
+					then
+						start = math.ceil(window - room * window / prev)
+					end
+					if start < window
+					then
+						if w == idx and start < elapsed
+						then
+							start = elapsed
+						end
+						return w, (w - idx) * window + start - elapsed
+					end
+				end
+				w = w + 1
+			end
+		end
+	`
+
+	luaCounterAcquire = luaCounterCommonFuc + `
+		local key = KEYS[1]
+		local count = tonumber(ARGV[5])
+		local counts = loadCounts(key)
+
+		local n = avail(counts)
+		if n <= 0
+		then
+			return 0
+		end
+
+		if count > n
+		then
+			count = n
+		end
+		add(key, counts, idx, count)
+
+		return count
+	`
+
+	luaCounterAvailable = luaCounterCommonFuc + `
+		return avail(loadCounts(KEYS[1]))
+	`
+
+	luaCounterTryAcquire = luaCounterCommonFuc + `
+		local key = KEYS[1]
+		local count = tonumber(ARGV[5])
+		local maxWait = tonumber(ARGV[6])
+		if count > capacity
+		then
+			-- The tokens never fit in the window
+			return -1
+		end
+		local counts = loadCounts(key)
+
+		local w, wait = find(counts, count)
+		if wait > maxWait
+		then
+			-- Refuse without taking any token
+			return -1
+		end
+		add(key, counts, w, count)
+		return wait
+	`
+
+	luaCounterAllow = luaCounterCommonFuc + `
+		local key = KEYS[1]
+		local count = tonumber(ARGV[5])
+		local counts = loadCounts(key)
+
+		local n = avail(counts)
+		local allowed, granted, retryAfter = 0, 0, 0
+		if count <= math.max(n, 0)
+		then
+			allowed, granted = 1, math.max(count, 0)
+			if granted > 0
 			then
-				return 0
+				add(key, counts, idx, granted)
+				n = n - granted
 			end
+		elseif count > capacity
+		then
+			-- The tokens never fit in the window
+			retryAfter = -1
+		else
+			local _, wait = find(counts, count)
+			retryAfter = wait
+		end
 
-			local endTick = tick + (-avail + quantum - 1) / quantum
-			local endTime = startTime + endTick * fillInterval
+		-- The bucket is full again when the latest window holding
+		-- tokens is not the previous one anymore
+		local latest = idx - 2
+		for i, c in pairs(counts)
+		do
+			local w = i + idx - 2
+			if c > 0 and w > latest
+			then
+				latest = w
+			end
+		end
+		local resetAfter = 0
+		if latest >= idx - 1
+		then
+			resetAfter = (latest + 2 - idx) * window - elapsed
+		end
+		return {allowed, granted, math.max(n, 0), capacity, resetAfter, retryAfter}
+	`
 
-			return endTime
+	luaCounterRefund = luaCounterCommonFuc + `
+		local key = KEYS[1]
+		local count = tonumber(ARGV[5])
+		local counts = loadCounts(key)
+
+		-- Remove the tokens from the window they are available in,
+		-- ARGV[6] nanoseconds from now
+		local w = idx + math.floor((elapsed + tonumber(ARGV[6])) / window)
+		local n = math.min(get(counts, w), count)
+		if n > 0
+		then
+			redis.call("hincrby", key, string.format("%d", w), -n)
 		end
 
-  		return nil
+		return 0
 	`
 )
+
+// luaQuotaAcquire takes calls from the key of a quota period.
+//
+//	KEYS[1]  the key of the period
+//	ARGV[1]  the limit of the quota
+//	ARGV[2]  the unix time the key expires at
+//	ARGV[3]  count
+const luaQuotaAcquire = `
+	local key = KEYS[1]
+	local limit = tonumber(ARGV[1])
+	local count = tonumber(ARGV[3])
+	local used = tonumber(redis.call("get", key) or "0")
+
+	local avail = limit - used
+	if avail <= 0
+	then
+		return 0
+	end
+
+	if count > avail
+	then
+		count = avail
+	end
+	redis.call("incrby", key, count)
+	redis.call("expireat", key, ARGV[2])
+
+	return count
+`
+
+// luaPermitNow reads the clock of Redis in milliseconds if ARGV[1] is empty.
+const luaPermitNow = `
+	if ARGV[1] == ""
+	then
+		local sec, usec = serverTime()
+		ARGV[1] = sec .. string.sub(usec, 1, 3)
+	end
+`
+
+// luaPermitAcquire takes a permit of a concurrency limiter. The permits are
+// the members of a sorted set scored by the end of their lease, the ended
+// leases are dropped first.
+//
+//	KEYS[1]  the key of the limiter
+//	ARGV[1]  the current unix time in milliseconds
+//	ARGV[2]  the lease of the permits in milliseconds
+//	ARGV[3]  the limit of the permits
+//	ARGV[4]  the id of the permit
+const luaPermitAcquire = luaServerTimeFuc + luaPermitNow + `
+	local key = KEYS[1]
+	local now = tonumber(ARGV[1])
+	local ttl = tonumber(ARGV[2])
+	local limit = tonumber(ARGV[3])
+
+	redis.call("zremrangebyscore", key, "-inf", now)
+	if redis.call("zcard", key) >= limit
+	then
+		return 0
+	end
+
+	redis.call("zadd", key, now + ttl, ARGV[4])
+	redis.call("pexpire", key, ttl)
+	return 1
+`
+
+// luaPermitRenew extends the lease of a permit, it returns 0 if the
+// permit is not held anymore.
+//
+//	KEYS[1]  the key of the limiter
+//	ARGV[1]  the current unix time in milliseconds
+//	ARGV[2]  the lease of the permits in milliseconds
+//	ARGV[3]  the id of the permit
+const luaPermitRenew = luaServerTimeFuc + luaPermitNow + `
+	local key = KEYS[1]
+	local now = tonumber(ARGV[1])
+	local ttl = tonumber(ARGV[2])
+
+	local lease = redis.call("zscore", key, ARGV[3])
+	if not lease or tonumber(lease) <= now
+	then
+		return 0
+	end
+
+	redis.call("zadd", key, now + ttl, ARGV[3])
+	redis.call("pexpire", key, ttl)
+	return 1
+`
+
+// luaPermitInFlight returns the number of permits whose lease has not ended.
+//
+//	KEYS[1]  the key of the limiter
+//	ARGV[1]  the current unix time in milliseconds
+const luaPermitInFlight = luaServerTimeFuc + luaPermitNow + `
+	return redis.call("zcount", KEYS[1], "(" .. ARGV[1], "+inf")
+`
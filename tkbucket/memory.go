@@ -1,7 +1,10 @@
 package tkbucket
 
 import (
+	"container/list"
+	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +20,10 @@ type memoryBucket struct {
 	quantum int64
 	// fillInterval holds the interval between each tick.
 	fillInterval time.Duration
+	// continuous holds whether the bucket refills a token at a time,
+	// quantum tokens every fillInterval, rather than quantum tokens
+	// on each tick. A tick is then the arrival of a token.
+	continuous bool
 	// mu guards the fields below it.
 	mu sync.Mutex
 	// avail holds the number of available
@@ -25,6 +32,7 @@ type memoryBucket struct {
 	// latestTick holds the latest tick for which we know
 	// the number of tokens in the bucket.
 	latestTick int64
+	accessTime
 }
 
 func (b *memoryBucket) StartTime() time.Time {
@@ -38,17 +46,11 @@ func (b *memoryBucket) Capacity() int64 {
 // Acquire takes up to count immediately available tokens from the bucket
 // result > 0，sufficient token
 func (b *memoryBucket) Acquire(count int64) int64 {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-
 	return b.acquire(time.Now(), count)
 }
 
 // TryAcquire try to acquire the token from the bucket
 func (b *memoryBucket) TryAcquire(count int64) time.Duration {
-	b.mu.Lock()
-	defer b.mu.Unlock()
-
 	d, _ := b.tryAcquire(time.Now(), count, infinityDuration)
 	return d
 }
@@ -60,17 +62,64 @@ func (b *memoryBucket) Wait(count int64) {
 	}
 }
 
+// WaitContext try to acquire the token from the bucket and wait util to get it,
+// or until ctx is done.
+func (b *memoryBucket) WaitContext(ctx context.Context, count int64) error {
+	return waitContext(ctx, b, count)
+}
+
+// WaitMaxDuration try to acquire the token from the bucket and wait util to get it,
+// if it needs to wait for no greater than maxWait.
+func (b *memoryBucket) WaitMaxDuration(count int64, maxWait time.Duration) bool {
+	return waitMaxDuration(b, count, maxWait)
+}
+
+// Reserve books count tokens from the bucket, see Reservation.
+func (b *memoryBucket) Reserve(count int64) *Reservation {
+	return reserve(b, time.Now(), count, infinityDuration)
+}
+
 // Available returns the number of available tokens.
 func (b *memoryBucket) Available() int64 {
 	return b.available(time.Now())
 }
 
+// AcquireE is like Acquire, the memoryBucket never fails.
+func (b *memoryBucket) AcquireE(count int64) (int64, error) {
+	return b.acquireE(time.Now(), count)
+}
+
+// TryAcquireE is like TryAcquire, the memoryBucket never fails.
+func (b *memoryBucket) TryAcquireE(count int64) (time.Duration, error) {
+	return b.tryAcquireE(time.Now(), count, infinityDuration)
+}
+
+// AvailableE is like Available, the memoryBucket never fails.
+func (b *memoryBucket) AvailableE() (int64, error) {
+	return b.availableE(time.Now())
+}
+
+// Allow takes count tokens if they are all available, see Decision.
+func (b *memoryBucket) Allow(count int64) Decision {
+	return b.allow(time.Now(), count)
+}
+
+// AllowE is like Allow, the memoryBucket never fails.
+func (b *memoryBucket) AllowE(count int64) (Decision, error) {
+	return b.allowE(time.Now(), count)
+}
+
 // acquire is the internal version of TakeAvailable - it takes the
 // current time as an argument to enable easy testing.
 func (b *memoryBucket) acquire(now time.Time, count int64) int64 {
+	b.touch(now)
 	if count <= 0 {
 		return 0
 	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	b.adjustAvail(b.currentTick(now))
 	if b.avail <= 0 {
 		return 0
@@ -85,10 +134,14 @@ func (b *memoryBucket) acquire(now time.Time, count int64) int64 {
 // tryAcquire is the internal version of Take - it takes the current time as
 // an argument to enable easy testing.
 func (b *memoryBucket) tryAcquire(now time.Time, count int64, maxWait time.Duration) (time.Duration, bool) {
+	b.touch(now)
 	if count <= 0 {
 		return 0, true
 	}
 
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	tick := b.currentTick(now)
 	b.adjustAvail(tick)
 	avail := b.avail - count
@@ -97,11 +150,7 @@ func (b *memoryBucket) tryAcquire(now time.Time, count int64, maxWait time.Durat
 		return 0, true
 	}
 
-	// endTick holds the tick when all the requested tokens will
-	// become available.
-	endTick := tick + (-avail+b.quantum-1)/b.quantum
-	endTime := b.startTime.Add(time.Duration(endTick) * b.fillInterval)
-	waitTime := endTime.Sub(now)
+	waitTime := b.waitTime(now, tick, -avail)
 	if waitTime > maxWait {
 		return 0, false
 	}
@@ -120,60 +169,333 @@ func (b *memoryBucket) available(now time.Time) int64 {
 	return b.avail
 }
 
+// allow is the internal version of Allow - it takes the current time as
+// an argument to enable easy testing.
+func (b *memoryBucket) allow(now time.Time, count int64) Decision {
+	b.touch(now)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tick := b.currentTick(now)
+	b.adjustAvail(tick)
+	d, avail := decide(count, b.avail, b.capacity, func(missing int64) time.Duration {
+		return b.waitTime(now, tick, missing)
+	})
+	b.avail = avail
+	return d
+}
+
+func (b *memoryBucket) acquireE(now time.Time, count int64) (int64, error) {
+	return b.acquire(now, count), nil
+}
+
+func (b *memoryBucket) tryAcquireE(now time.Time, count int64, maxWait time.Duration) (time.Duration, error) {
+	d, ok := b.tryAcquire(now, count, maxWait)
+	if !ok {
+		return 0, ErrWaitTooLong
+	}
+	return d, nil
+}
+
+func (b *memoryBucket) availableE(now time.Time) (int64, error) {
+	return b.available(now), nil
+}
+
+func (b *memoryBucket) allowE(now time.Time, count int64) (Decision, error) {
+	return b.allow(now, count), nil
+}
+
+// refund returns count tokens that were reserved by tryAcquire but not
+// consumed yet to the bucket.
+func (b *memoryBucket) refund(now, at time.Time, count int64) error {
+	b.touch(now)
+	if count <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.adjustAvail(b.currentTick(now))
+	b.avail += count
+	if b.avail > b.capacity {
+		b.avail = b.capacity
+	}
+	return nil
+}
+
 // currentTick returns the current time tick, measured
 // from b.startTime.
 func (b *memoryBucket) currentTick(now time.Time) int64 {
+	if b.continuous {
+		tick, _ := mulDiv(int64(now.Sub(b.startTime)), b.quantum, int64(b.fillInterval))
+		return tick
+	}
 	return int64(now.Sub(b.startTime) / b.fillInterval)
 }
 
+// waitTime returns how long to wait from now, at tick, until
+// missing more tokens are available.
+func (b *memoryBucket) waitTime(now time.Time, tick, missing int64) time.Duration {
+	if b.continuous {
+		return continuousWait(now.Sub(b.startTime), missing, b.fillInterval, b.quantum)
+	}
+	// endTick holds the tick when all the requested tokens will
+	// become available.
+	endTick := tick + (missing+b.quantum-1)/b.quantum
+	endTime := b.startTime.Add(time.Duration(endTick) * b.fillInterval)
+	return endTime.Sub(now)
+}
+
 // adjustAvail adjusts the current number of tokens
 // available in the memoryBucket at the given time, which must
 // be in the future (positive) with respect to b.latestTick.
 func (b *memoryBucket) adjustAvail(tick int64) {
-	if b.avail >= b.capacity {
-		return
-	}
-	b.avail += (tick - b.latestTick) * b.quantum
-	if b.avail > b.capacity {
-		b.avail = b.capacity
+	// The ticks of a full bucket don't add tokens, they are passed too.
+	if b.avail < b.capacity {
+		if b.continuous {
+			b.avail += tick - b.latestTick
+		} else {
+			b.avail += (tick - b.latestTick) * b.quantum
+		}
+		if b.avail > b.capacity {
+			b.avail = b.capacity
+		}
 	}
 	b.latestTick = tick
 }
 
-// MemoryStorage is a memoryBucket factory.
+// memoryShards holds the number of shards of a MemoryStorage,
+// it must be a power of 2.
+const memoryShards = 256
+
+// memoryKind is the kind of the values of a MemoryStorage,
+// the names of each kind are distinct.
+type memoryKind int
+
+const (
+	bucketKind memoryKind = iota
+	quotaKind
+	concurrencyKind
+)
+
+// memoryKey is the key of a value of a MemoryStorage.
+type memoryKey struct {
+	kind memoryKind
+	name string
+}
+
+// memoryEntry holds a bucket, a quota or a concurrency
+// limiter of a MemoryStorage.
+type memoryEntry struct {
+	// lastAccess holds the last time, in unix nanoseconds, the value
+	// was returned by Create or used. It is first to be 64-bit aligned.
+	lastAccess int64
+	key        memoryKey
+	value      interface{}
+	// elem holds the position of the entry in the LRU list of the shard,
+	// if MaxEntries is set.
+	elem *list.Element
+	// listed holds the lastAccess of the entry when it was last moved to
+	// the front of the LRU list, it is guarded by the mutex of the shard.
+	listed int64
+}
+
+// memoryShard is a part of the entries of a MemoryStorage.
+type memoryShard struct {
+	// mu guards the fields below it.
+	mu      sync.RWMutex
+	entries map[memoryKey]*memoryEntry
+	// lru holds the entries, the most recently used first,
+	// if MaxEntries is set.
+	lru *list.List
+}
+
+// MemoryOptions configures the buckets of a MemoryStorage and their eviction.
+type MemoryOptions struct {
+	// MaxEntries bounds the number of buckets, quotas and concurrency
+	// limiters, the least recently used ones are evicted beyond it. The
+	// concurrency limiters with permits in flight are kept. Zero means
+	// no bound.
+	MaxEntries int
+	// IdleTimeout is how long a bucket, a quota or a concurrency limiter
+	// must be unused before the janitor evicts it. Only the buckets
+	// refilled to capacity, the quotas unused in the current period and
+	// the concurrency limiters without permits in flight are evicted, they
+	// are identical to the fresh ones created on next use. Zero disables
+	// the janitor.
+	IdleTimeout time.Duration
+	// JanitorInterval is how often the janitor looks for idle buckets,
+	// it defaults to IdleTimeout.
+	JanitorInterval time.Duration
+	// LockFree creates lock-free buckets updated with atomic operations,
+	// which scale better than the locked ones when a bucket is hot.
+	LockFree bool
+	// Algorithm selects how the buckets count their tokens, it defaults
+	// to TokenBucket. LockFree only applies to TokenBucket, GCRA buckets
+	// are always lock-free.
+	Algorithm Algorithm
+}
+
+// MemoryStorage is a memoryBucket factory, safe for concurrent use.
+// The buckets are spread over shards locked independently, so that
+// creating buckets for many keys concurrently doesn't contend on a lock.
+// The quotas and the concurrency limiters are kept and evicted the same way.
+//
+// The buckets record their use, so a bucket kept by the caller is only
+// evicted once it is the least recently used or idle. When buckets are
+// evicted, the caller should still get the bucket from Create on every use
+// rather than keeping it, or it may use an evicted bucket again while the
+// others use a fresh one.
 type MemoryStorage struct {
-	buckets map[string]*memoryBucket
+	opts   MemoryOptions
+	shards [memoryShards]memoryShard
+	// stats holds the counters returned by Stats.
+	stats memoryStats
+	// done stops the janitor.
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-// NewMemoryStorage initializes the in-memory memoryBucket store.
+// NewMemoryStorage initializes the in-memory memoryBucket store,
+// the buckets are never evicted.
 func NewMemoryStorage() *MemoryStorage {
-	return &MemoryStorage{
-		buckets: make(map[string]*memoryBucket),
+	return NewMemoryStorageWithOptions(MemoryOptions{})
+}
+
+// NewMemoryStorageWithOptions initializes the in-memory memoryBucket store
+// evicting the buckets as configured by opts. Close must be called to stop
+// the janitor when IdleTimeout is set.
+func NewMemoryStorageWithOptions(opts MemoryOptions) *MemoryStorage {
+	if opts.MaxEntries < 0 {
+		panic("memory storage max entries is < 0")
+	}
+	if opts.IdleTimeout < 0 {
+		panic("memory storage idle timeout is < 0")
+	}
+	if opts.JanitorInterval <= 0 {
+		opts.JanitorInterval = opts.IdleTimeout
+	}
+	s := &MemoryStorage{
+		opts: opts,
+		done: make(chan struct{}),
 	}
+	for i := range s.shards {
+		s.shards[i].entries = make(map[memoryKey]*memoryEntry)
+		if opts.MaxEntries > 0 {
+			s.shards[i].lru = list.New()
+		}
+	}
+	if opts.IdleTimeout > 0 {
+		go s.janitor()
+	}
+	return s
 }
 
 func (s *MemoryStorage) Ping() error { return nil }
 
 // Create create a memoryBucket.
 func (s *MemoryStorage) Create(name string, fillInterval time.Duration, capacity int64) (Bucket, error) {
-	b, ok := s.buckets[name]
-	if ok {
-		return b, nil
-	}
-	b = create(name, fillInterval, capacity, 1)
-	s.buckets[name] = b
-	return b, nil
+	return s.CreateWithQuantum(name, fillInterval, capacity, 1)
 }
 
 // CreateWithQuantum create a memoryBucket with quantum.
 func (s *MemoryStorage) CreateWithQuantum(name string, fillInterval time.Duration, capacity, quantum int64) (Bucket, error) {
-	b, ok := s.buckets[name]
+	return s.get(time.Now(), memoryKey{bucketKind, name}, func() interface{} {
+		if s.opts.Algorithm == TokenBucket && s.opts.LockFree {
+			return createAtomic(name, fillInterval, capacity, quantum)
+		}
+		return createWithAlgorithm(s.opts.Algorithm, name, fillInterval, capacity, quantum)
+	}).(Bucket), nil
+}
+
+// CreateWithRate create a memoryBucket refilled continuously with
+// ratePerSecond tokens per second, see Storage. LockFree doesn't apply,
+// the other algorithms get the fillInterval and quantum of the rate.
+func (s *MemoryStorage) CreateWithRate(name string, ratePerSecond float64, capacity int64) (Bucket, error) {
+	fillInterval, quantum := rateOf(ratePerSecond)
+	return s.get(time.Now(), memoryKey{bucketKind, name}, func() interface{} {
+		if s.opts.Algorithm == TokenBucket {
+			return createContinuous(name, fillInterval, capacity, quantum)
+		}
+		return createWithAlgorithm(s.opts.Algorithm, name, fillInterval, capacity, quantum)
+	}).(Bucket), nil
+}
+
+// get returns the value of key, created with newValue if it does not exist.
+func (s *MemoryStorage) get(now time.Time, key memoryKey, newValue func() interface{}) interface{} {
+	shard := s.shard(key.name)
+	if shard.lru == nil {
+		shard.mu.RLock()
+		e, ok := shard.entries[key]
+		shard.mu.RUnlock()
+		if ok {
+			atomic.StoreInt64(&e.lastAccess, now.UnixNano())
+			return e.value
+		}
+	}
+
+	shard.mu.Lock()
+	// The value may have been created while the lock was released.
+	e, ok := shard.entries[key]
 	if ok {
-		return b, nil
+		atomic.StoreInt64(&e.lastAccess, now.UnixNano())
+		if shard.lru != nil {
+			shard.lru.MoveToFront(e.elem)
+			e.listed = now.UnixNano()
+		}
+		shard.mu.Unlock()
+		return e.value
+	}
+	e = &memoryEntry{
+		lastAccess: now.UnixNano(),
+		key:        key,
+		value:      newValue(),
+		listed:     now.UnixNano(),
 	}
-	b = create(name, fillInterval, capacity, quantum)
-	s.buckets[name] = b
-	return b, nil
+	if v, ok := e.value.(accessTracker); ok {
+		v.track(&e.lastAccess)
+	}
+	if shard.lru != nil {
+		e.elem = shard.lru.PushFront(e)
+	}
+	shard.entries[key] = e
+	shard.mu.Unlock()
+
+	n := atomic.AddInt64(&s.stats.buckets, 1)
+	if max := int64(s.opts.MaxEntries); max > 0 && n > max {
+		s.evictLRU(key)
+	}
+	return e.value
+}
+
+// shard returns the shard holding the values of name.
+func (s *MemoryStorage) shard(name string) *memoryShard {
+	return &s.shards[shardIndex(name)]
+}
+
+// shardIndex returns the index of the shard holding the values of name.
+func shardIndex(name string) int {
+	// FNV-1a, inlined to avoid allocations.
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return int(h & (memoryShards - 1))
+}
+
+// createWithAlgorithm creates a memory bucket counting its tokens with algorithm.
+func createWithAlgorithm(algorithm Algorithm, name string, fillInterval time.Duration, capacity, quantum int64) Bucket {
+	switch algorithm {
+	case GCRA:
+		return createGCRA(name, fillInterval, capacity, quantum)
+	case SlidingWindowLog:
+		return createWindowLog(name, fillInterval, capacity, quantum)
+	case SlidingWindowCounter:
+		return createWindowCounter(name, fillInterval, capacity, quantum)
+	}
+	return create(name, fillInterval, capacity, quantum)
 }
 
 func create(name string, fillInterval time.Duration, capacity, quantum int64) *memoryBucket {
@@ -195,3 +517,11 @@ func create(name string, fillInterval time.Duration, capacity, quantum int64) *m
 		avail:        capacity,
 	}
 }
+
+// createContinuous creates a memoryBucket refilled a token at a time,
+// quantum tokens every fillInterval.
+func createContinuous(name string, fillInterval time.Duration, capacity, quantum int64) *memoryBucket {
+	b := create(name, fillInterval, capacity, quantum)
+	b.continuous = true
+	return b
+}
@@ -1,7 +1,10 @@
 package tkbucket
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"testing"
@@ -323,6 +326,121 @@ func TestMemoryTryAcquire(t *testing.T) {
 	}
 }
 
+//------------------------------------Wait Test------------------------------------------
+func TestMemoryWaitContext(t *testing.T) {
+	asserts := assert.New(t)
+
+	nms := NewMemoryStorage()
+	tb, err := nms.Create("msf_token_bucket", 200*time.Millisecond, 1)
+	asserts.Nil(err, "Token bucket create failed")
+	asserts.Nil(tb.WaitContext(context.Background(), 1), "tokens are available")
+
+	// The deadline is before the token arrives, nothing should be taken.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	asserts.Equal(ErrWaitTooLong, tb.WaitContext(ctx, 1))
+	asserts.Equal(false, tb.WaitMaxDuration(1, 50*time.Millisecond))
+
+	// Cancel while waiting, the reserved token must be given back.
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	asserts.Equal(context.Canceled, tb.WaitContext(ctx, 1))
+	d := tb.TryAcquire(1)
+	asserts.True(d > 0 && d <= 200*time.Millisecond, fmt.Sprintf("got wait %v after refund", d))
+	fmt.Println("WaitContextTest: -> success")
+}
+
+func TestMemoryRefund(t *testing.T) {
+	asserts := assert.New(t)
+
+	nms := NewMemoryStorage()
+	tb, err := nms.Create("msf_token_bucket", 250*time.Millisecond, 10)
+	asserts.Nil(err, "Token bucket create failed")
+
+	start := tb.StartTime()
+	tb.tryAcquire(start, 10, infinityDuration)
+	d, _ := tb.tryAcquire(start, 2, infinityDuration)
+	asserts.Equal(500*time.Millisecond, d)
+	tb.refund(start.Add(100*time.Millisecond), start.Add(100*time.Millisecond), 2)
+	asserts.Equal(int64(0), tb.available(start.Add(100*time.Millisecond)))
+	asserts.Equal(int64(1), tb.available(start.Add(250*time.Millisecond)))
+
+	// Refunds never overflow the capacity.
+	tb.refund(start.Add(time.Hour), start.Add(time.Hour), 5)
+	asserts.Equal(int64(10), tb.available(start.Add(time.Hour)))
+	fmt.Println("RefundTest: -> success")
+}
+
+//------------------------------------Reserve Test------------------------------------------
+func TestMemoryReserve(t *testing.T) {
+	asserts := assert.New(t)
+
+	nms := NewMemoryStorage()
+	tb, err := nms.Create("msf_token_bucket", 250*time.Millisecond, 10)
+	asserts.Nil(err, "Token bucket create failed")
+
+	start := tb.StartTime()
+	r := reserve(tb, start, 10, infinityDuration)
+	asserts.True(r.OK())
+	asserts.Equal(time.Duration(0), r.DelayFrom(start))
+
+	r = reserve(tb, start, 2, infinityDuration)
+	asserts.True(r.OK())
+	asserts.Equal(500*time.Millisecond, r.DelayFrom(start))
+	asserts.Equal(250*time.Millisecond, r.DelayFrom(start.Add(250*time.Millisecond)))
+
+	// Too long to wait, nothing is taken.
+	r2 := reserve(tb, start, 1, 100*time.Millisecond)
+	asserts.False(r2.OK())
+	asserts.Equal(infinityDuration, r2.DelayFrom(start))
+	r2.CancelAt(start)
+
+	// Cancel twice only refunds once.
+	r.CancelAt(start.Add(100 * time.Millisecond))
+	r.CancelAt(start.Add(100 * time.Millisecond))
+	asserts.Equal(int64(1), tb.available(start.Add(250*time.Millisecond)))
+
+	// The tokens are consumed by time, cancel does nothing.
+	r = reserve(tb, start.Add(250*time.Millisecond), 2, infinityDuration)
+	asserts.Equal(250*time.Millisecond, r.DelayFrom(start.Add(250*time.Millisecond)))
+	r.CancelAt(start.Add(500 * time.Millisecond))
+	asserts.Equal(int64(0), tb.available(start.Add(500*time.Millisecond)))
+	fmt.Println("ReserveTest: -> success")
+}
+
+//------------------------------------Storage Test------------------------------------------
+func TestMemoryStorageConcurrent(t *testing.T) {
+	asserts := assert.New(t)
+
+	nms := NewMemoryStorage()
+	const workers, keys = 8, 1000
+	buckets := make([][]Bucket, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keys; i++ {
+				b, err := nms.Create(fmt.Sprintf("msf_token_bucket_:%d", i), time.Second, 10)
+				asserts.Nil(err, "Token bucket create failed")
+				buckets[w] = append(buckets[w], b)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// Every worker got the same bucket for the same name.
+	for w := 1; w < workers; w++ {
+		for i := 0; i < keys; i++ {
+			asserts.True(buckets[0][i] == buckets[w][i], fmt.Sprintf("worker %d got another bucket %d", w, i))
+		}
+	}
+	fmt.Println("StorageConcurrentTest: -> success")
+}
+
 func TestMemoryPanics(t *testing.T) {
 	asserts := assert.New(t)
 
@@ -360,3 +478,58 @@ func BenchmarkMemoryAcquire(b *testing.B) {
 		tb.Acquire(1)
 	}
 }
+
+// The storage benchmarks are meant to be run with several values
+// of GOMAXPROCS to show how they scale, e.g.
+//	go test -run NONE -bench MemoryStorage -cpu 1,2,4,8,16
+const benchKeyCount = 1 << 20
+
+var (
+	benchKeysOnce sync.Once
+	benchKeys     []string
+)
+
+// loadBenchKeys returns a million per-user bucket keys.
+func loadBenchKeys() []string {
+	benchKeysOnce.Do(func() {
+		benchKeys = make([]string, benchKeyCount)
+		for i := range benchKeys {
+			benchKeys[i] = fmt.Sprintf("service:1:method:Get:userid:%d:tk_bucket", i)
+		}
+	})
+	return benchKeys
+}
+
+func BenchmarkMemoryStorageCreate(b *testing.B) {
+	keys := loadBenchKeys()
+	nms := NewMemoryStorage()
+	var worker uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// Every goroutine walks the keys from its own offset.
+		i := atomic.AddUint64(&worker, 1) << 16
+		for pb.Next() {
+			i++
+			nms.Create(keys[i&(benchKeyCount-1)], time.Second, 10)
+		}
+	})
+}
+
+func BenchmarkMemoryStorageAcquire(b *testing.B) {
+	keys := loadBenchKeys()
+	nms := NewMemoryStorage()
+	for _, key := range keys {
+		nms.Create(key, time.Second, 10)
+	}
+	var worker uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// Every goroutine walks the keys from its own offset.
+		i := atomic.AddUint64(&worker, 1) << 16
+		for pb.Next() {
+			i++
+			tb, _ := nms.Create(keys[i&(benchKeyCount-1)], time.Second, 10)
+			tb.Acquire(1)
+		}
+	})
+}
@@ -0,0 +1,278 @@
+package tkbucket
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// MultiBucket takes tokens from several buckets all-or-nothing, e.g. from
+// the cluster, service and user buckets of a request, so that the tokens of
+// a bucket are not lost when another one refuses.
+//
+// The redisBucket token buckets of the same Client are updated by a single
+// script when their keys are in the same slot: a plain client, or keys with
+// the same hash tag, e.g. "{svc}:cluster" and "{svc}:user:1". Otherwise the
+// tokens are taken from each bucket in turn and refunded if one refuses, so
+// the refused tokens may be seen as taken for a moment.
+type MultiBucket struct {
+	buckets []Bucket
+	// redis holds the buckets if they can be updated by a single script.
+	redis []*redisBucket
+}
+
+// NewMultiBucket creates a MultiBucket of buckets, which must be distinct.
+func NewMultiBucket(buckets ...Bucket) *MultiBucket {
+	if len(buckets) == 0 {
+		panic("multi bucket has no bucket")
+	}
+	for i, a := range buckets {
+		for _, b := range buckets[:i] {
+			if sameBucket(a, b) {
+				panic("multi bucket has a bucket twice")
+			}
+		}
+	}
+	return &MultiBucket{
+		buckets: buckets,
+		redis:   sameSlotBuckets(buckets),
+	}
+}
+
+// Buckets returns the buckets of the MultiBucket.
+func (m *MultiBucket) Buckets() []Bucket {
+	return m.buckets
+}
+
+// Acquire takes count tokens from all the buckets if they are all
+// available, and reports whether they were taken.
+func (m *MultiBucket) Acquire(count int64) bool {
+	return m.AcquireE(count) == nil
+}
+
+// AcquireE is like Acquire, but returns ErrWaitTooLong when a bucket has
+// not enough tokens, or the error of a bucket which failed.
+func (m *MultiBucket) AcquireE(count int64) error {
+	_, _, err := m.tryAcquireE(time.Now(), count, 0)
+	return err
+}
+
+// WaitMaxDuration waits for count tokens of all the buckets if they are
+// all available within maxWait, and reports whether they were taken.
+func (m *MultiBucket) WaitMaxDuration(count int64, maxWait time.Duration) bool {
+	d, _, err := m.tryAcquireE(time.Now(), count, maxWait)
+	if err != nil {
+		return false
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+	return true
+}
+
+// WaitContext waits for count tokens of all the buckets until ctx is done.
+// It returns ErrWaitTooLong without waiting if the tokens are not available
+// before the deadline of ctx. The tokens are refunded if ctx is done while
+// waiting.
+func (m *MultiBucket) WaitContext(ctx context.Context, count int64) error {
+	// Don't touch the buckets if the ctx is already done.
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	now := time.Now()
+	maxWait := infinityDuration
+	if deadline, ok := ctx.Deadline(); ok {
+		maxWait = deadline.Sub(now)
+	}
+	d, ats, err := m.tryAcquireE(now, count, maxWait)
+	if err != nil || d <= 0 {
+		return err
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		m.refund(time.Now(), count, ats)
+		return ctx.Err()
+	}
+}
+
+// Available returns the tokens available in all the buckets, the lowest
+// of their available tokens. The buckets are not read atomically.
+func (m *MultiBucket) Available() int64 {
+	now := time.Now()
+	avail := m.buckets[0].available(now)
+	for _, b := range m.buckets[1:] {
+		if n := b.available(now); n < avail {
+			avail = n
+		}
+	}
+	return avail
+}
+
+// tryAcquireE reserves count tokens in all the buckets if they are all
+// available within maxWait, and returns the longest wait and the time
+// the tokens of each bucket are available at.
+func (m *MultiBucket) tryAcquireE(now time.Time, count int64, maxWait time.Duration) (time.Duration, []time.Time, error) {
+	if m.redis == nil {
+		return tryAcquireAll(m.buckets, now, count, maxWait)
+	}
+
+	d, err := m.evalTryAcquire(now, count, maxWait)
+	if err == nil {
+		ats := make([]time.Time, len(m.buckets))
+		for i := range ats {
+			ats[i] = now.Add(d)
+		}
+		return d, ats, nil
+	}
+	if err == ErrWaitTooLong {
+		return 0, nil, err
+	}
+	// The FailurePolicy is applied once, rather than by each
+	// bucket calling Redis again.
+	switch m.redis[0].fail(err) {
+	case FailOpen:
+		ats := make([]time.Time, len(m.buckets))
+		for i := range ats {
+			ats[i] = now
+		}
+		return 0, ats, nil
+	case FailLocal:
+		local := make([]Bucket, len(m.redis))
+		for i, r := range m.redis {
+			local[i] = r.localBucket()
+		}
+		return tryAcquireAll(local, now, count, maxWait)
+	}
+	return 0, nil, err
+}
+
+// refund gives count tokens back to the first buckets,
+// available at ats.
+func (m *MultiBucket) refund(now time.Time, count int64, ats []time.Time) {
+	refundAll(m.buckets, now, count, ats)
+}
+
+// tryAcquireAll reserves count tokens in each of buckets in turn, and
+// refunds them if a bucket refuses or fails.
+func tryAcquireAll(buckets []Bucket, now time.Time, count int64, maxWait time.Duration) (time.Duration, []time.Time, error) {
+	ats := make([]time.Time, 0, len(buckets))
+	var wait time.Duration
+	for _, b := range buckets {
+		d, err := b.tryAcquireE(now, count, maxWait)
+		if err != nil {
+			refundAll(buckets, now, count, ats)
+			return 0, nil, err
+		}
+		ats = append(ats, now.Add(d))
+		if d > wait {
+			wait = d
+		}
+	}
+	return wait, ats, nil
+}
+
+// refundAll gives count tokens back to the first buckets, available at ats.
+func refundAll(buckets []Bucket, now time.Time, count int64, ats []time.Time) {
+	for i, at := range ats {
+		// The tokens of a bucket which fails are lost.
+		_ = buckets[i].refund(now, at, count)
+	}
+}
+
+func (m *MultiBucket) evalTryAcquire(now time.Time, count int64, maxWait time.Duration) (time.Duration, error) {
+	if count <= 0 {
+		return 0, nil
+	}
+
+	keys := make([]string, len(m.redis))
+	args := []interface{}{
+		m.redis[0].storage.timeArg(now.UnixNano()),
+		count,
+		strconv.FormatInt(int64(maxWait), 10),
+	}
+	for i, r := range m.redis {
+		keys[i] = r.Key
+		// The parameters of the bucket follow the current time.
+		args = append(args, r.args(now)[1:]...)
+	}
+
+	// Execute lua script, EVALSHA falls back to EVAL on NOSCRIPT
+	res, err := scriptMultiTryAcquire.Run(m.redis[0].Client, keys, args...).Result()
+	if err != nil {
+		return 0, m.redis[0].evalError("luaMultiTryAcquire", err)
+	}
+	if res.(int64) < 0 {
+		return 0, ErrWaitTooLong
+	}
+	return time.Duration(res.(int64)), nil
+}
+
+// sameSlotBuckets returns the buckets as redisBuckets if they can be
+// updated by a single script, nil otherwise. They must come from the
+// same RedisStorage, which provides the clock and the FailurePolicy.
+func sameSlotBuckets(buckets []Bucket) []*redisBucket {
+	rs := make([]*redisBucket, len(buckets))
+	for i, b := range buckets {
+		r, ok := b.(*redisBucket)
+		if !ok || r.algorithm != TokenBucket {
+			return nil
+		}
+		rs[i] = r
+	}
+
+	_, cluster := rs[0].Client.(*redis.ClusterClient)
+	_, ring := rs[0].Client.(*redis.Ring)
+	for _, r := range rs[1:] {
+		if r.storage != rs[0].storage || r.Client != rs[0].Client {
+			return nil
+		}
+		// The keys are spread by their hash tag.
+		if (cluster || ring) && hashTag(r.Key) != hashTag(rs[0].Key) {
+			return nil
+		}
+	}
+	return rs
+}
+
+// sameBucket reports whether a and b count the same tokens: the same
+// bucket, or the buckets of the same key in the same Redis.
+func sameBucket(a, b Bucket) bool {
+	if a == b {
+		return true
+	}
+	ra, rb := remoteOf(a), remoteOf(b)
+	return ra != nil && rb != nil && ra.Client == rb.Client && ra.Key == rb.Key
+}
+
+// remoteOf returns the redisBucket counting the tokens of b, if any.
+func remoteOf(b Bucket) *redisBucket {
+	switch b := b.(type) {
+	case *redisBucket:
+		return b
+	case *hybridBucket:
+		return b.remote
+	}
+	return nil
+}
+
+// hashTag returns the part of key hashed to find its slot: the hash tag
+// between the first braces if it is not empty, or the whole key.
+func hashTag(key string) string {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			return key[s+1 : s+1+e]
+		}
+	}
+	return key
+}
@@ -0,0 +1,120 @@
+package tkbucket
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+//------------------------------------MultiBucket Test------------------------------------------
+func TestMultiBucket(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, kind := range []string{"memory", "redis", "mixed"} {
+		clusterStorage := newStorage(kind, TokenBucket)
+		userStorage := clusterStorage
+		if kind == "mixed" {
+			userStorage = NewMemoryStorage()
+		}
+		user, _ := userStorage.Create("msf_multi_user", 100*time.Millisecond, 2)
+		cluster, _ := clusterStorage.Create("msf_multi_cluster", time.Second, 3)
+		m := NewMultiBucket(user, cluster)
+		asserts.Equal(kind == "redis", m.redis != nil, kind+" single script")
+
+		// The user bucket was created first.
+		now := cluster.StartTime()
+		d, _, err := m.tryAcquireE(now, 2, 0)
+		asserts.Nil(err, kind)
+		asserts.Equal(time.Duration(0), d, kind)
+
+		// The user bucket refuses, the cluster bucket keeps its token.
+		_, _, err = m.tryAcquireE(now, 1, 0)
+		asserts.Equal(ErrWaitTooLong, err, kind)
+		asserts.Equal(int64(1), cluster.available(now), kind)
+
+		// The wait is the longest of the buckets.
+		d, _, err = m.tryAcquireE(now, 1, 200*time.Millisecond)
+		asserts.Nil(err, kind)
+		want := user.StartTime().Add(100 * time.Millisecond).Sub(now)
+		asserts.Equal(want, d, kind)
+
+		// The cluster bucket refuses, the token reserved in the user bucket is given back.
+		_, _, err = m.tryAcquireE(now, 1, 500*time.Millisecond)
+		asserts.Equal(ErrWaitTooLong, err, kind)
+		asserts.Equal(int64(1), user.available(now.Add(200*time.Millisecond)), kind)
+		asserts.Equal(int64(0), cluster.available(now), kind)
+		fmt.Println("MultiBucketTest:", kind, "-> success")
+	}
+}
+
+func TestMultiBucketFailure(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(downClient, bucketExpire)
+	remote, _ := nrs.Create("msf_multi_remote", time.Second, 1)
+	nrs.Policy = FailClosed
+	local, _ := NewMemoryStorage().Create("msf_multi_local", time.Second, 1)
+
+	m := NewMultiBucket(local, remote)
+	asserts.True(errors.Is(m.AcquireE(1), ErrStorageUnavailable))
+	asserts.Equal(int64(1), local.Available(), "the local token is given back")
+
+	nrs.Policy = FailOpen
+	asserts.True(m.Acquire(1))
+	asserts.Equal(int64(0), m.Available())
+
+	// The policy of the buckets of a single script is applied once.
+	var failures int
+	nrs.OnFailure = func(key string, policy FailurePolicy, err error) {
+		failures++
+	}
+	remote2, _ := nrs.Create("msf_multi_remote2", time.Second, 1)
+	m = NewMultiBucket(remote, remote2)
+	for _, policy := range []FailurePolicy{FailOpen, FailClosed, FailLocal} {
+		nrs.Policy = policy
+		failures = 0
+		about := fmt.Sprint(policy)
+		asserts.Equal(policy == FailClosed, errors.Is(m.AcquireE(1), ErrStorageUnavailable), about)
+		asserts.Equal(1, failures, about)
+	}
+	// The local buckets are all-or-nothing too.
+	failures = 0
+	asserts.True(errors.Is(m.AcquireE(1), ErrWaitTooLong))
+	asserts.Equal(1, failures)
+	fmt.Println("MultiBucketFailureTest: -> success")
+}
+
+func TestMultiBucketSlot(t *testing.T) {
+	asserts := assert.New(t)
+
+	asserts.Equal("svc", hashTag("{svc}:user:1"))
+	asserts.Equal("svc", hashTag("cluster:{svc}"))
+	asserts.Equal("{}:svc", hashTag("{}:svc"))
+	asserts.Equal("svc", hashTag("svc"))
+
+	cluster := NewRedisStorage(redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{":7000"}}), bucketExpire)
+	user := cluster.newBucket("{svc}:user:1", time.Second, 1, 1)
+	svc := cluster.newBucket("{svc}:service", time.Second, 1, 1)
+	other := cluster.newBucket("{other}:service", time.Second, 1, 1)
+	asserts.NotNil(sameSlotBuckets([]Bucket{user, svc}), "same hash tag")
+	asserts.Nil(sameSlotBuckets([]Bucket{user, other}), "other hash tag")
+
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	asserts.NotNil(sameSlotBuckets([]Bucket{nrs.newBucket("a", time.Second, 1, 1), nrs.newBucket("b", time.Second, 1, 1)}), "plain client")
+	asserts.Nil(sameSlotBuckets([]Bucket{user, nrs.newBucket("{svc}:a", time.Second, 1, 1)}), "other client")
+	// The storage provides the clock and the FailurePolicy.
+	nrs2 := NewRedisStorage(redisClient, bucketExpire)
+	nrs2.ServerTime = true
+	asserts.Nil(sameSlotBuckets([]Bucket{nrs.newBucket("a", time.Second, 1, 1), nrs2.newBucket("b", time.Second, 1, 1)}), "other storage")
+
+	// A bucket is not taken from twice.
+	a := nrs.newBucket("a", time.Second, 1, 1)
+	asserts.Panics(func() { NewMultiBucket(a, a) })
+	asserts.Panics(func() { NewMultiBucket(a, nrs2.newBucket("a", time.Second, 1, 1)) }, "same key")
+	asserts.NotPanics(func() { NewMultiBucket(a, cluster.newBucket("a", time.Second, 1, 1)) }, "other client")
+	fmt.Println("MultiBucketSlotTest: -> success")
+}
@@ -0,0 +1,53 @@
+package tkbucket
+
+// FailurePolicy decides how a bucket backed by a remote storage
+// behaves when the storage can not be used.
+type FailurePolicy int
+
+const (
+	// FailOpen bypasses the limiter: every request gets its tokens.
+	FailOpen FailurePolicy = iota
+	// FailClosed refuses every request.
+	FailClosed
+	// FailLocal falls back to a local memoryBucket created
+	// with the same parameters as the remote bucket.
+	FailLocal
+)
+
+func (p FailurePolicy) String() string {
+	switch p {
+	case FailOpen:
+		return "fail-open"
+	case FailClosed:
+		return "fail-closed"
+	case FailLocal:
+		return "fail-local"
+	}
+	return "unknown"
+}
+
+// FailureFunc is called with the key of the bucket and the error
+// whenever a FailurePolicy kicks in.
+type FailureFunc func(key string, policy FailurePolicy, err error)
+
+// ConflictPolicy decides what happens when a bucket is created with
+// other parameters than the existing bucket of the same key.
+type ConflictPolicy int
+
+const (
+	// ConflictError refuses to create the bucket with ErrBucketConflict.
+	ConflictError ConflictPolicy = iota
+	// ConflictUpdate applies the new parameters to the existing bucket,
+	// keeping the tokens it holds up to the new capacity.
+	ConflictUpdate
+)
+
+func (p ConflictPolicy) String() string {
+	switch p {
+	case ConflictError:
+		return "conflict-error"
+	case ConflictUpdate:
+		return "conflict-update"
+	}
+	return "unknown"
+}
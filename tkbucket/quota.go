@@ -0,0 +1,393 @@
+package tkbucket
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// QuotaPeriod is the calendar period a Quota is reset on.
+type QuotaPeriod int
+
+const (
+	// Daily quotas are reset at midnight.
+	Daily QuotaPeriod = iota
+	// Monthly quotas are reset at midnight on the first day of the month.
+	Monthly
+)
+
+func (p QuotaPeriod) String() string {
+	switch p {
+	case Daily:
+		return "daily"
+	case Monthly:
+		return "monthly"
+	}
+	return "unknown"
+}
+
+// bounds returns the start and the end of the period holding t in loc.
+// The days are calendar days, 23 or 25 hours long when the daylight saving
+// time changes.
+func (p QuotaPeriod) bounds(t time.Time, loc *time.Location) (time.Time, time.Time) {
+	t = t.In(loc)
+	y, m, d := t.Date()
+	if p == Monthly {
+		start := time.Date(y, m, 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// suffix returns the suffix of the Redis key of the period starting at start.
+func (p QuotaPeriod) suffix(start time.Time) string {
+	if p == Monthly {
+		return start.Format("200601")
+	}
+	return start.Format("20060102")
+}
+
+// Quota counts the calls of a key in calendar periods, e.g. for billing.
+// Unlike a Bucket, the calls are not refilled over time, the whole quota
+// is available again at the start of the next period.
+type Quota interface {
+	// Acquire takes up to count calls from the quota of the current period.
+	// > 0 means that the calls were obtained.
+	Acquire(count int64) int64
+	// AcquireE is like Acquire, but returns an error instead of 0 when
+	// the quota could not be read.
+	AcquireE(count int64) (int64, error)
+	// Remaining returns the number of calls left in the current period.
+	Remaining() int64
+	// RemainingE is like Remaining, but returns an error when the
+	// quota could not be read.
+	RemainingE() (int64, error)
+	// ResetAt returns the time the current period ends at.
+	ResetAt() time.Time
+	// Limit returns the number of calls allowed in a period.
+	Limit() int64
+	// acquireE is the internal version - to enable easy testing.
+	acquireE(now time.Time, count int64) (int64, error)
+	// remainingE is the internal version - to enable easy testing.
+	remainingE(now time.Time) (int64, error)
+	// resetAt is the internal version - to enable easy testing.
+	resetAt(now time.Time) time.Time
+}
+
+// QuotaStorage is implemented by the storages which create quotas.
+type QuotaStorage interface {
+	// CreateQuota creates a quota of limit calls per period with a name,
+	// the periods are aligned on the calendar of loc, UTC if nil.
+	CreateQuota(name string, period QuotaPeriod, limit int64, loc *time.Location) (Quota, error)
+}
+
+// memoryQuota is a Quota kept in memory.
+type memoryQuota struct {
+	period QuotaPeriod
+	limit  int64
+	loc    *time.Location
+	// mu guards the fields below it.
+	mu sync.Mutex
+	// end holds the end of the period of used.
+	end time.Time
+	// used holds the calls taken in the period.
+	used int64
+	accessTime
+}
+
+// Acquire takes up to count calls from the quota of the current period.
+func (q *memoryQuota) Acquire(count int64) int64 {
+	n, _ := q.acquireE(time.Now(), count)
+	return n
+}
+
+// AcquireE is like Acquire, the memoryQuota never fails.
+func (q *memoryQuota) AcquireE(count int64) (int64, error) {
+	return q.acquireE(time.Now(), count)
+}
+
+// Remaining returns the number of calls left in the current period.
+func (q *memoryQuota) Remaining() int64 {
+	n, _ := q.remainingE(time.Now())
+	return n
+}
+
+// RemainingE is like Remaining, the memoryQuota never fails.
+func (q *memoryQuota) RemainingE() (int64, error) {
+	return q.remainingE(time.Now())
+}
+
+// ResetAt returns the time the current period ends at.
+func (q *memoryQuota) ResetAt() time.Time {
+	return q.resetAt(time.Now())
+}
+
+func (q *memoryQuota) Limit() int64 {
+	return q.limit
+}
+
+func (q *memoryQuota) acquireE(now time.Time, count int64) (int64, error) {
+	q.touch(now)
+	if count <= 0 {
+		return 0, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.adjust(now)
+	avail := q.limit - q.used
+	if avail <= 0 {
+		return 0, nil
+	}
+	if count > avail {
+		count = avail
+	}
+	q.used += count
+	return count, nil
+}
+
+func (q *memoryQuota) remainingE(now time.Time) (int64, error) {
+	q.touch(now)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.adjust(now)
+	return q.limit - q.used, nil
+}
+
+func (q *memoryQuota) resetAt(now time.Time) time.Time {
+	_, end := q.period.bounds(now, q.loc)
+	return end
+}
+
+// idle reports whether no call is taken in the period holding now.
+func (q *memoryQuota) idle(now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.used == 0 || !now.Before(q.end)
+}
+
+// adjust starts a new period if the period of used is over at now.
+func (q *memoryQuota) adjust(now time.Time) {
+	if now.Before(q.end) {
+		return
+	}
+	_, q.end = q.period.bounds(now, q.loc)
+	q.used = 0
+}
+
+// redisQuota is a Quota stored in Redis, with a key per period
+// expiring a bit after the end of the period.
+type redisQuota struct {
+	Key     string
+	Client  redis.UniversalClient
+	storage *RedisStorage
+	period  QuotaPeriod
+	limit   int64
+	loc     *time.Location
+	// localOnce guards local, the fallback quota of FailLocal.
+	localOnce sync.Once
+	local     *memoryQuota
+}
+
+// Acquire takes up to count calls from the quota of the current period.
+// The FailurePolicy of the RedisStorage is applied.
+func (q *redisQuota) Acquire(count int64) int64 {
+	n, _ := q.acquireE(time.Now(), count)
+	return n
+}
+
+// AcquireE is like Acquire, but reports why no call could be taken.
+// The FailurePolicy is not applied, the error is returned as is.
+func (q *redisQuota) AcquireE(count int64) (int64, error) {
+	return q.evalAcquire(time.Now(), count)
+}
+
+// Remaining returns the number of calls left in the current period.
+// The FailurePolicy of the RedisStorage is applied.
+func (q *redisQuota) Remaining() int64 {
+	n, _ := q.remainingE(time.Now())
+	return n
+}
+
+// RemainingE is like Remaining, but reports storage failures.
+// The FailurePolicy is not applied, the error is returned as is.
+func (q *redisQuota) RemainingE() (int64, error) {
+	return q.getRemaining(time.Now())
+}
+
+// ResetAt returns the time the current period ends at.
+func (q *redisQuota) ResetAt() time.Time {
+	return q.resetAt(time.Now())
+}
+
+func (q *redisQuota) Limit() int64 {
+	return q.limit
+}
+
+// acquireE is evalAcquire with the FailurePolicy applied.
+func (q *redisQuota) acquireE(now time.Time, count int64) (int64, error) {
+	n, err := q.evalAcquire(now, count)
+	if err == nil {
+		return n, nil
+	}
+	switch q.storage.fail(q.Key, err) {
+	case FailOpen:
+		return count, nil
+	case FailLocal:
+		return q.localQuota().acquireE(now, count)
+	}
+	return 0, err
+}
+
+// remainingE is getRemaining with the FailurePolicy applied.
+func (q *redisQuota) remainingE(now time.Time) (int64, error) {
+	n, err := q.getRemaining(now)
+	if err == nil {
+		return n, nil
+	}
+	switch q.storage.fail(q.Key, err) {
+	case FailOpen:
+		return q.limit, nil
+	case FailLocal:
+		return q.localQuota().remainingE(now)
+	}
+	return 0, err
+}
+
+// resetAt returns the end of the period of the clock of Redis with
+// ServerTime, or of now if Redis cannot be read.
+func (q *redisQuota) resetAt(now time.Time) time.Time {
+	if t, err := q.clock(now); err == nil {
+		now = t
+	}
+	_, end := q.period.bounds(now, q.loc)
+	return end
+}
+
+// clock returns now, or the time of Redis with RedisStorage.ServerTime.
+// The periods follow the calendar of loc, unknown to the scripts: the time
+// is read before rather than in the scripts.
+func (q *redisQuota) clock(now time.Time) (time.Time, error) {
+	if !q.storage.ServerTime {
+		return now, nil
+	}
+	t, err := q.Client.Time().Result()
+	if err != nil {
+		return now, fmt.Errorf("%w: time: %v", ErrStorageUnavailable, err)
+	}
+	return t, nil
+}
+
+// localQuota returns the fallback quota of FailLocal.
+func (q *redisQuota) localQuota() *memoryQuota {
+	q.localOnce.Do(func() {
+		q.local = &memoryQuota{period: q.period, limit: q.limit, loc: q.loc}
+	})
+	return q.local
+}
+
+// periodKey returns the key of the period holding now, and its end.
+func (q *redisQuota) periodKey(now time.Time) (string, time.Time) {
+	start, end := q.period.bounds(now, q.loc)
+	return q.Key + ":" + q.period.suffix(start), end
+}
+
+func (q *redisQuota) evalAcquire(now time.Time, count int64) (int64, error) {
+	if count <= 0 {
+		return 0, nil
+	}
+
+	now, err := q.clock(now)
+	if err != nil {
+		return 0, err
+	}
+	key, end := q.periodKey(now)
+	// Keep the key a bit longer, for the clocks which are late.
+	expireAt := end.Add(defaultExpireMargin).Unix()
+
+	// Execute lua script, EVALSHA falls back to EVAL on NOSCRIPT
+	res, err := scriptQuotaAcquire.Run(
+		q.Client,
+		[]string{key},
+		q.limit,
+		strconv.FormatInt(expireAt, 10),
+		count,
+	).Result()
+	if err != nil {
+		return 0, fmt.Errorf("%w: eval luaQuotaAcquire: %v", ErrStorageUnavailable, err)
+	}
+
+	return res.(int64), nil
+}
+
+func (q *redisQuota) getRemaining(now time.Time) (int64, error) {
+	now, err := q.clock(now)
+	if err != nil {
+		return 0, err
+	}
+	key, _ := q.periodKey(now)
+	used, err := q.Client.Get(key).Int64()
+	if err == redis.Nil {
+		return q.limit, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%w: get %s: %v", ErrStorageUnavailable, key, err)
+	}
+	if used > q.limit {
+		return 0, nil
+	}
+	return q.limit - used, nil
+}
+
+// CreateQuota creates a memoryQuota. The quotas are evicted like the
+// buckets, see MemoryOptions, and the existing quota of name is returned
+// whatever the parameters.
+func (s *MemoryStorage) CreateQuota(name string, period QuotaPeriod, limit int64, loc *time.Location) (Quota, error) {
+	checkQuota(period, limit)
+	if loc == nil {
+		loc = time.UTC
+	}
+	return s.get(time.Now(), memoryKey{quotaKind, name}, func() interface{} {
+		return &memoryQuota{period: period, limit: limit, loc: loc}
+	}).(*memoryQuota), nil
+}
+
+// CreateQuota creates a redisQuota. Nothing is stored until the quota is used,
+// the calls of each period are counted under the key suffixed with the
+// period, e.g. "key:20260131" or "key:202601".
+func (r *RedisStorage) CreateQuota(key string, period QuotaPeriod, limit int64, loc *time.Location) (Quota, error) {
+	checkQuota(period, limit)
+	if loc == nil {
+		loc = time.UTC
+	}
+	return &redisQuota{
+		Key:     key,
+		Client:  r.Client,
+		storage: r,
+		period:  period,
+		limit:   limit,
+		loc:     loc,
+	}, nil
+}
+
+// CreateQuota creates a redisQuota, see RedisStorage.CreateQuota.
+// The calls are not leased.
+func (s *HybridStorage) CreateQuota(key string, period QuotaPeriod, limit int64, loc *time.Location) (Quota, error) {
+	return s.Redis.CreateQuota(key, period, limit, loc)
+}
+
+func checkQuota(period QuotaPeriod, limit int64) {
+	if period != Daily && period != Monthly {
+		panic("quota period is unknown")
+	}
+	if limit <= 0 {
+		panic("quota limit is not > 0")
+	}
+}
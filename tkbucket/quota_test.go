@@ -0,0 +1,128 @@
+package tkbucket
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//------------------------------------Quota Test------------------------------------------
+func TestQuotaDaily(t *testing.T) {
+	asserts := assert.New(t)
+
+	loc := time.FixedZone("UTC+8", 8*60*60)
+	for _, kind := range storageKinds {
+		q, err := newStorage(kind, TokenBucket).CreateQuota("msf_quota", Daily, 10, loc)
+		asserts.Nil(err, "Quota create failed")
+
+		// A day in the future, so that the Redis keys don't expire.
+		y, m, d := time.Now().In(loc).Date()
+		midnight := time.Date(y, m, d+2, 0, 0, 0, 0, loc)
+		now := midnight.Add(-time.Hour)
+
+		asserts.Equal(int64(10), q.Limit(), kind)
+		asserts.Equal(midnight, q.resetAt(now), kind)
+		n, err := q.acquireE(now, 7)
+		asserts.Nil(err, kind)
+		asserts.Equal(int64(7), n, kind)
+		n, _ = q.acquireE(now.Add(30*time.Minute), 5)
+		asserts.Equal(int64(3), n, kind)
+		n, _ = q.remainingE(midnight.Add(-time.Nanosecond))
+		asserts.Equal(int64(0), n, kind)
+
+		// The quota is reset at midnight in loc.
+		n, _ = q.remainingE(midnight)
+		asserts.Equal(int64(10), n, kind)
+		n, _ = q.acquireE(midnight, 1)
+		asserts.Equal(int64(1), n, kind)
+		asserts.Equal(midnight.AddDate(0, 0, 1), q.resetAt(midnight), kind)
+		fmt.Println("QuotaDailyTest:", kind, "-> success")
+	}
+}
+
+func TestQuotaMonthly(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, kind := range storageKinds {
+		q, err := newStorage(kind, TokenBucket).CreateQuota("msf_quota", Monthly, 100, nil)
+		asserts.Nil(err, "Quota create failed")
+
+		// The last day of the next month.
+		y, m, _ := time.Now().UTC().Date()
+		first := time.Date(y, m+2, 1, 0, 0, 0, 0, time.UTC)
+		now := first.AddDate(0, 0, -1)
+
+		asserts.Equal(first, q.resetAt(now), kind)
+		n, _ := q.acquireE(now, 60)
+		asserts.Equal(int64(60), n, kind)
+		n, _ = q.remainingE(now.AddDate(0, 0, -10))
+		asserts.Equal(int64(40), n, kind)
+		n, _ = q.remainingE(first)
+		asserts.Equal(int64(100), n, kind)
+		fmt.Println("QuotaMonthlyTest:", kind, "-> success")
+	}
+}
+
+func TestQuotaBounds(t *testing.T) {
+	asserts := assert.New(t)
+
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+
+	// The daylight saving time ends on 2026-11-01, the day lasts 25 hours.
+	start, end := Daily.bounds(time.Date(2026, 11, 1, 12, 0, 0, 0, loc), loc)
+	asserts.Equal(time.Date(2026, 11, 1, 0, 0, 0, 0, loc), start)
+	asserts.Equal(25*time.Hour, end.Sub(start))
+	asserts.Equal("20261101", Daily.suffix(start))
+
+	start, end = Monthly.bounds(time.Date(2026, 1, 31, 23, 0, 0, 0, time.UTC), loc)
+	asserts.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, loc), start)
+	asserts.Equal(time.Date(2026, 2, 1, 0, 0, 0, 0, loc), end)
+	asserts.Equal("202601", Monthly.suffix(start))
+	fmt.Println("QuotaBoundsTest: -> success")
+}
+
+func TestQuotaRedisExpire(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	nrs.Client.FlushDB()
+	q, err := nrs.CreateQuota("msf_quota", Daily, 10, nil)
+	asserts.Nil(err, "Quota create failed")
+
+	now := time.Now()
+	asserts.Equal(int64(1), q.Acquire(1))
+	start, end := Daily.bounds(now, time.UTC)
+	key := "msf_quota:" + start.Format("20060102")
+	asserts.Equal("1", nrs.Client.Get(key).Val())
+	ttl := nrs.Client.TTL(key).Val()
+	want := end.Add(defaultExpireMargin).Sub(now)
+	asserts.True(ttl > want-2*time.Second && ttl <= want+time.Second, fmt.Sprintf("got ttl %v want %v", ttl, want))
+	fmt.Println("QuotaRedisExpireTest: -> success")
+}
+
+func TestQuotaFailurePolicy(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(downClient, bucketExpire)
+	q, err := nrs.CreateQuota("msf_quota", Daily, 10, nil)
+	asserts.Nil(err, "Quota create failed")
+
+	_, err = q.AcquireE(1)
+	asserts.True(errors.Is(err, ErrStorageUnavailable))
+	asserts.Equal(int64(20), q.Acquire(20), "fail-open")
+
+	nrs.Policy = FailClosed
+	asserts.Equal(int64(0), q.Acquire(1))
+	asserts.Equal(int64(0), q.Remaining())
+
+	nrs.Policy = FailLocal
+	asserts.Equal(int64(10), q.Acquire(20))
+	asserts.Equal(int64(0), q.Remaining())
+	fmt.Println("QuotaFailurePolicyTest: -> success")
+}
@@ -0,0 +1,92 @@
+package tkbucket
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+const (
+	// maxRateSeconds bounds the fillInterval of the buckets created with a
+	// rate, in seconds, so that their ticks are exact in the lua scripts.
+	maxRateSeconds = 100000
+	// maxRateQuantum bounds the quantum of the buckets created with a rate.
+	maxRateQuantum = 100000000000000
+)
+
+// rateOf returns the fillInterval and the quantum of a bucket refilled
+// with ratePerSecond tokens per second: the closest fraction of tokens
+// per whole seconds, up to maxRateSeconds seconds. 1/3 is exactly one
+// token every 3 seconds, 2.7 is 27 tokens every 10 seconds.
+func rateOf(ratePerSecond float64) (time.Duration, int64) {
+	if !(ratePerSecond > 0) || math.IsInf(ratePerSecond, 1) {
+		panic("token bucket rate is not > 0")
+	}
+	if ratePerSecond >= maxRateQuantum {
+		panic("token bucket rate is too high")
+	}
+	if ratePerSecond < 1.0/maxRateSeconds {
+		panic("token bucket rate is too low")
+	}
+
+	// The convergents of the continued fraction of the rate are its
+	// closest fractions, h/k tokens every k seconds.
+	h, h1 := int64(1), int64(0)
+	k, k1 := int64(0), int64(1)
+	x := ratePerSecond
+	for {
+		a := math.Floor(x)
+		// The bounds are checked before converting, a huge a overflows.
+		if a*float64(k)+float64(k1) > maxRateSeconds || a*float64(h)+float64(h1) > maxRateQuantum {
+			break
+		}
+		nh, nk := int64(a)*h+h1, int64(a)*k+k1
+		h, h1, k, k1 = nh, h, nk, k
+		if float64(h)/float64(k) == ratePerSecond || x == a {
+			break
+		}
+		x = 1 / (x - a)
+	}
+	if h == 0 || k == 0 {
+		panic("token bucket rate is too low")
+	}
+
+	fillInterval := k * int64(time.Second)
+	g := gcd(h, fillInterval)
+	return time.Duration(fillInterval / g), h / g
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// mulDiv returns a*b/c truncated toward zero and the remainder, without
+// overflowing the product. b and c must be > 0, the quotient saturates.
+func mulDiv(a, b, c int64) (int64, int64) {
+	sign := int64(1)
+	if a < 0 {
+		sign = -1
+	}
+	hi, lo := bits.Mul64(uint64(a*sign), uint64(b))
+	if hi >= uint64(c) {
+		return sign * math.MaxInt64, 0
+	}
+	q, r := bits.Div64(hi, lo, uint64(c))
+	if q > math.MaxInt64 {
+		return sign * math.MaxInt64, 0
+	}
+	return sign * int64(q), sign * int64(r)
+}
+
+// continuousWait returns how long a continuous bucket, refilled with quantum
+// tokens every fillInterval, waits for missing tokens at elapsed after its
+// start. The tokens arrive at the nanosecond, the fractions of a token
+// accrued since the start are carried forward.
+func continuousWait(elapsed time.Duration, missing int64, fillInterval time.Duration, quantum int64) time.Duration {
+	_, rem := mulDiv(int64(elapsed), quantum, int64(fillInterval))
+	n, r := mulDiv(missing, int64(fillInterval), quantum)
+	return time.Duration(n + floorDiv(r-rem+quantum-1, quantum))
+}
@@ -0,0 +1,81 @@
+package tkbucket
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//------------------------------------Rate Test------------------------------------------
+func TestRateOf(t *testing.T) {
+	asserts := assert.New(t)
+
+	var rateTests = []struct {
+		rate         float64
+		fillInterval time.Duration
+		quantum      int64
+	}{
+		{3, time.Second, 3},
+		{0.5, 2 * time.Second, 1},
+		{1.0 / 3, 3 * time.Second, 1},
+		{2.7, 10 * time.Second, 27},
+		{1000.0 / 3, 3 * time.Millisecond, 1},
+		{1e9, time.Nanosecond, 1},
+		{1e-5, 100000 * time.Second, 1},
+		{math.Nextafter(maxRateQuantum, 0), time.Nanosecond, maxRateQuantum / int64(time.Second)},
+	}
+	for _, test := range rateTests {
+		fillInterval, quantum := rateOf(test.rate)
+		asserts.Equal(test.fillInterval, fillInterval, fmt.Sprintf("rate %v", test.rate))
+		asserts.Equal(test.quantum, quantum, fmt.Sprintf("rate %v", test.rate))
+	}
+
+	var badRates = []float64{
+		0, -1, math.NaN(), math.Inf(1),
+		1e-6, 1e-12, 1e-300, math.Nextafter(1.0/maxRateSeconds, 0),
+		maxRateQuantum, math.Nextafter(maxRateQuantum, math.Inf(1)), 1e15,
+	}
+	for _, rate := range badRates {
+		asserts.Panics(func() { rateOf(rate) }, fmt.Sprintf("rate %v", rate))
+	}
+	fmt.Println("RateOfTest: -> success")
+}
+
+func TestCreateWithRate(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, kind := range storageKinds {
+		s := newStorage(kind, TokenBucket)
+		tb, err := s.CreateWithRate("msf_rate_bucket", 3, 3)
+		asserts.Nil(err, "Token bucket create failed")
+		start := tb.StartTime()
+
+		asserts.Equal(int64(3), tb.acquire(start, 3), kind)
+		// A token every third of a second, to the nanosecond.
+		asserts.Equal(int64(0), tb.available(start.Add(333333333)), kind)
+		asserts.Equal(int64(1), tb.available(start.Add(333333334)), kind)
+		asserts.Equal(int64(2), tb.available(start.Add(666666667)), kind)
+		asserts.Equal(int64(3), tb.available(start.Add(time.Second)), kind)
+
+		// The fractions of a token are carried forward, there is no drift.
+		asserts.Equal(int64(3), tb.acquire(start.Add(1000*time.Second), 3), kind)
+		d, ok := tb.tryAcquire(start.Add(1000*time.Second+100*time.Millisecond), 2, infinityDuration)
+		asserts.True(ok, kind)
+		asserts.Equal(566666667*time.Nanosecond, d, kind)
+		asserts.Equal(int64(-1), tb.available(start.Add(1000*time.Second+666666666)), kind)
+		asserts.Equal(int64(0), tb.available(start.Add(1000*time.Second+666666667)), kind)
+		asserts.Equal(int64(1), tb.available(start.Add(1000*time.Second+time.Second)), kind)
+		fmt.Println("CreateWithRateTest:", kind, "-> success")
+	}
+
+	s := newStorage("redis", TokenBucket)
+	_, err := s.CreateWithRate("msf_rate_bucket", 3, 3)
+	asserts.Nil(err, "Token bucket create failed")
+	_, err = s.CreateWithQuantum("msf_rate_bucket", time.Second, 3, 3)
+	asserts.True(errors.Is(err, ErrBucketConflict), "a stepped bucket conflicts with a continuous one")
+	fmt.Println("CreateWithRateConflictTest: -> success")
+}
@@ -1,11 +1,12 @@
 package tkbucket
 
 import (
+	"context"
+	"fmt"
 	"strconv"
+	"sync"
 	"time"
 
-	"log"
-
 	"github.com/go-redis/redis"
 )
 
@@ -18,18 +19,57 @@ const (
 	latestTickField   = "latest_tick"
 )
 
+// defaultExpireMargin is added to the refill time of a bucket
+// to get its default TTL.
+const defaultExpireMargin = time.Minute
+
 type redisBucket struct {
 	Key    string
-	Client *redis.Client
+	Client redis.UniversalClient
+	// storage holds the RedisStorage which created the bucket,
+	// it provides the FailurePolicy.
+	storage *RedisStorage
+	// fillInterval, capacity and quantum hold the parameters
+	// the bucket was created with.
+	fillInterval time.Duration
+	capacity     int64
+	quantum      int64
+	// continuous holds whether the token bucket refills a token at a time,
+	// see memoryBucket.
+	continuous bool
+	// algorithm holds how the tokens are counted in Redis.
+	algorithm Algorithm
+	// startTime holds the moment when the bucket was created,
+	// token buckets store it in Redis.
+	startTime time.Time
+	// localOnce guards local, the fallback bucket of FailLocal.
+	localOnce sync.Once
+	local     Bucket
 }
 
+// StartTime returns the start time stored in Redis, or the time the
+// bucket was created at if the key is gone or Redis fails.
 func (r *redisBucket) StartTime() time.Time {
-	st, _ := r.Client.HGet(r.Key, startTimeField).Int64()
+	if r.algorithm != TokenBucket {
+		return r.startTime
+	}
+	st, err := r.Client.HGet(r.Key, startTimeField).Int64()
+	if err != nil {
+		return r.startTime
+	}
 	return time.Unix(0, st)
 }
 
+// Capacity returns the capacity stored in Redis, or the capacity the
+// bucket was created with if the key is gone or Redis fails.
 func (r *redisBucket) Capacity() int64 {
-	c, _ := r.Client.HGet(r.Key, capacityField).Int64()
+	if r.algorithm != TokenBucket {
+		return r.capacity
+	}
+	c, err := r.Client.HGet(r.Key, capacityField).Int64()
+	if err != nil {
+		return r.capacity
+	}
 	return c
 }
 
@@ -39,185 +79,559 @@ func (r *redisBucket) Acquire(count int64) int64 {
 	return r.acquire(time.Now(), count)
 }
 
-// TryAcquire try to acquire the token from the bucket
+// TryAcquire try to acquire the token from the bucket.
+// It returns infinityDuration if the request is refused by FailClosed.
 func (r *redisBucket) TryAcquire(count int64) time.Duration {
-	d, _ := r.tryAcquire(time.Now(), count, infinityDuration)
+	d, ok := r.tryAcquire(time.Now(), count, infinityDuration)
+	if !ok {
+		return infinityDuration
+	}
 	return d
 }
 
+// Wait try to acquire the token from the bucket and wait util to get it.
+// It returns immediately if the request is refused by FailClosed,
+// use WaitContext to know about it.
 func (r *redisBucket) Wait(count int64) {
-	if d := r.TryAcquire(count); d > 0 {
+	if d, ok := r.tryAcquire(time.Now(), count, infinityDuration); ok && d > 0 {
 		time.Sleep(d)
 	}
 }
 
+// WaitContext try to acquire the token from the bucket and wait util to get it,
+// or until ctx is done.
+func (r *redisBucket) WaitContext(ctx context.Context, count int64) error {
+	return waitContext(ctx, r, count)
+}
+
+// WaitMaxDuration try to acquire the token from the bucket and wait util to get it,
+// if it needs to wait for no greater than maxWait.
+func (r *redisBucket) WaitMaxDuration(count int64, maxWait time.Duration) bool {
+	return waitMaxDuration(r, count, maxWait)
+}
+
+// Reserve books count tokens from the bucket, see Reservation.
+func (r *redisBucket) Reserve(count int64) *Reservation {
+	return reserve(r, time.Now(), count, infinityDuration)
+}
+
 // Available returns the number of available tokens.
 func (r *redisBucket) Available() int64 {
 	return r.available(time.Now())
 }
 
+// AcquireE is like Acquire, but reports why no token could be taken.
+// The FailurePolicy is not applied, the error is returned as is.
+func (r *redisBucket) AcquireE(count int64) (int64, error) {
+	return r.evalAcquire(time.Now(), count)
+}
+
+// TryAcquireE is like TryAcquire, but reports storage failures.
+// The FailurePolicy is not applied, the error is returned as is.
+func (r *redisBucket) TryAcquireE(count int64) (time.Duration, error) {
+	return r.evalTryAcquire(time.Now(), count, infinityDuration)
+}
+
+// AvailableE is like Available, but reports storage failures.
+// The FailurePolicy is not applied, the error is returned as is.
+func (r *redisBucket) AvailableE() (int64, error) {
+	return r.evalAvailable(time.Now())
+}
+
+// Allow takes count tokens if they are all available, see Decision.
+// The tokens are read and taken by a single script.
+func (r *redisBucket) Allow(count int64) Decision {
+	return r.allow(time.Now(), count)
+}
+
+// AllowE is like Allow, but reports storage failures.
+// The FailurePolicy is not applied, the error is returned as is.
+func (r *redisBucket) AllowE(count int64) (Decision, error) {
+	return r.evalAllow(time.Now(), count)
+}
+
 // acquire is the internal version of TakeAvailable - it takes the
 // current time as an argument to enable easy testing.
 func (r *redisBucket) acquire(now time.Time, count int64) int64 {
+	n, _ := r.acquireE(now, count)
+	return n
+}
+
+func (r *redisBucket) tryAcquire(now time.Time, count int64, maxWait time.Duration) (time.Duration, bool) {
+	d, err := r.tryAcquireE(now, count, maxWait)
+	return d, err == nil
+}
+
+// available is the internal version of available - it takes the current time as
+// an argument to enable easy testing.
+func (r *redisBucket) available(now time.Time) int64 {
+	n, _ := r.availableE(now)
+	return n
+}
+
+// allow is the internal version of Allow - it takes the current time as
+// an argument to enable easy testing.
+func (r *redisBucket) allow(now time.Time, count int64) Decision {
+	d, _ := r.allowE(now, count)
+	return d
+}
+
+// acquireE is evalAcquire with the FailurePolicy applied.
+func (r *redisBucket) acquireE(now time.Time, count int64) (int64, error) {
+	n, err := r.evalAcquire(now, count)
+	if err == nil {
+		return n, nil
+	}
+	return r.failAcquire(now, count, err)
+}
+
+// failAcquire applies the FailurePolicy to an acquire failed with err.
+func (r *redisBucket) failAcquire(now time.Time, count int64, err error) (int64, error) {
+	switch r.fail(err) {
+	case FailOpen:
+		return count, nil
+	case FailLocal:
+		return r.localBucket().acquireE(now, count)
+	}
+	return 0, err
+}
+
+// tryAcquireE is evalTryAcquire with the FailurePolicy applied.
+func (r *redisBucket) tryAcquireE(now time.Time, count int64, maxWait time.Duration) (time.Duration, error) {
+	d, err := r.evalTryAcquire(now, count, maxWait)
+	if err == nil || err == ErrWaitTooLong {
+		return d, err
+	}
+	return r.failTryAcquire(now, count, maxWait, err)
+}
+
+// failTryAcquire applies the FailurePolicy to a tryAcquire failed with err.
+func (r *redisBucket) failTryAcquire(now time.Time, count int64, maxWait time.Duration, err error) (time.Duration, error) {
+	switch r.fail(err) {
+	case FailOpen:
+		return 0, nil
+	case FailLocal:
+		return r.localBucket().tryAcquireE(now, count, maxWait)
+	}
+	return 0, err
+}
+
+// availableE is evalAvailable with the FailurePolicy applied.
+func (r *redisBucket) availableE(now time.Time) (int64, error) {
+	n, err := r.evalAvailable(now)
+	if err == nil {
+		return n, nil
+	}
+	switch r.fail(err) {
+	case FailOpen:
+		return r.capacity, nil
+	case FailLocal:
+		return r.localBucket().availableE(now)
+	}
+	return 0, err
+}
+
+// allowE is evalAllow with the FailurePolicy applied.
+func (r *redisBucket) allowE(now time.Time, count int64) (Decision, error) {
+	d, err := r.evalAllow(now, count)
+	if err == nil {
+		return d, nil
+	}
+	return r.failAllow(now, count, err)
+}
+
+// failAllow applies the FailurePolicy to an allow failed with err.
+func (r *redisBucket) failAllow(now time.Time, count int64, err error) (Decision, error) {
+	switch r.fail(err) {
+	case FailOpen:
+		return Decision{Allowed: true, Granted: maxInt64(count, 0), Remaining: r.capacity, Limit: r.capacity}, nil
+	case FailLocal:
+		return r.localBucket().allowE(now, count)
+	}
+	return Decision{Limit: r.capacity}, err
+}
+
+// refund returns count tokens that were reserved by tryAcquire but not
+// consumed yet to the bucket.
+func (r *redisBucket) refund(now, at time.Time, count int64) error {
+	err := r.evalRefund(now, at, count)
+	if err == nil {
+		return nil
+	}
+	switch r.fail(err) {
+	case FailOpen:
+		return nil
+	case FailLocal:
+		return r.localBucket().refund(now, at, count)
+	}
+	return err
+}
+
+// fail reports err to the storage and returns the policy to apply.
+func (r *redisBucket) fail(err error) FailurePolicy {
+	return r.storage.fail(r.Key, err)
+}
+
+// localBucket returns the fallback bucket of FailLocal,
+// counting its tokens with the same algorithm.
+func (r *redisBucket) localBucket() Bucket {
+	r.localOnce.Do(func() {
+		if r.continuous {
+			r.local = createContinuous(r.Key, r.fillInterval, r.capacity, r.quantum)
+			return
+		}
+		r.local = createWithAlgorithm(r.algorithm, r.Key, r.fillInterval, r.capacity, r.quantum)
+	})
+	return r.local
+}
+
+func (r *redisBucket) evalAcquire(now time.Time, count int64) (int64, error) {
 	if count <= 0 {
-		return 0
+		return 0, nil
 	}
 
-	// Execute lua script
-	res, err := r.Client.Eval(
-		luaAcquire,
+	// Execute lua script, EVALSHA falls back to EVAL on NOSCRIPT
+	res, err := algorithmScripts[r.algorithm].acquire.Run(
+		r.Client,
 		[]string{r.Key},
-		strconv.FormatInt(now.UnixNano(), 10),
-		count,
+		r.args(now, count)...,
 	).Result()
 	if err != nil {
-		if err != redis.Nil {
-			log.Printf("Eval luaAcquire: %v\n", err)
-		}
-		return 0
+		return 0, r.evalError("luaAcquire", err)
 	}
 
-	return res.(int64)
+	return res.(int64), nil
 }
 
-func (r *redisBucket) tryAcquire(now time.Time, count int64, maxWait time.Duration) (time.Duration, bool) {
+func (r *redisBucket) evalTryAcquire(now time.Time, count int64, maxWait time.Duration) (time.Duration, error) {
 	if count <= 0 {
-		return 0, true
+		return 0, nil
 	}
 
-	// Execute lua script
-	res, err := r.Client.Eval(
-		luaTryAcquire,
+	// Execute lua script, EVALSHA falls back to EVAL on NOSCRIPT
+	res, err := algorithmScripts[r.algorithm].tryAcquire.Run(
+		r.Client,
 		[]string{r.Key},
-		strconv.FormatInt(now.UnixNano(), 10),
-		count,
+		r.args(now, count, strconv.FormatInt(int64(maxWait/r.timeUnit()), 10))...,
 	).Result()
 	if err != nil {
-		if err != redis.Nil {
-			log.Printf("Eval luaTryAcquire: %v\n", err)
-			return 0, false
-		} else {
-			return 0, true
-		}
+		return 0, r.evalError("luaTryAcquire", err)
 	}
 
 	// token is enough
 	if res.(int64) == 0 {
-		return 0, true
+		return 0, nil
+	}
+	// waitTime > maxWait
+	if res.(int64) < 0 {
+		return 0, ErrWaitTooLong
 	}
 
-	waitTime := time.Duration(res.(int64) - now.UnixNano())
+	waitTime := time.Duration(res.(int64)) * r.timeUnit()
 	if waitTime > maxWait {
-		return 0, false
+		return 0, ErrWaitTooLong
 	}
-	return waitTime, true
+	return waitTime, nil
 }
 
-// available is the internal version of available - it takes the current time as
-// an argument to enable easy testing.
-func (r *redisBucket) available(now time.Time) int64 {
-	// Execute lua script
-	res, err := r.Client.Eval(
-		luaAvailable,
+func (r *redisBucket) evalAvailable(now time.Time) (int64, error) {
+	// Execute lua script, EVALSHA falls back to EVAL on NOSCRIPT
+	res, err := algorithmScripts[r.algorithm].available.Run(
+		r.Client,
 		[]string{r.Key},
-		strconv.FormatInt(now.UnixNano(), 10),
+		r.args(now)...,
 	).Result()
 	if err != nil {
-		if err != redis.Nil {
-			log.Printf("Eval luaAvailable: %v\n", err)
-		}
-		return 0
+		return 0, r.evalError("luaAvailable", err)
+	}
+
+	return res.(int64), nil
+}
+
+func (r *redisBucket) evalRefund(now, at time.Time, count int64) error {
+	if count <= 0 {
+		return nil
+	}
+
+	extra := []interface{}{count}
+	// The windows find the tokens with the time they are available at,
+	// relative to the current time to work with ServerTime too.
+	switch r.algorithm {
+	case SlidingWindowLog:
+		delay := at.UnixNano()/int64(time.Microsecond) - now.UnixNano()/int64(time.Microsecond)
+		extra = append(extra, strconv.FormatInt(delay, 10))
+	case SlidingWindowCounter:
+		extra = append(extra, strconv.FormatInt(int64(at.Sub(now)), 10))
 	}
 
-	return res.(int64)
+	// Execute lua script, EVALSHA falls back to EVAL on NOSCRIPT
+	err := algorithmScripts[r.algorithm].refund.Run(
+		r.Client,
+		[]string{r.Key},
+		r.args(now, extra...)...,
+	).Err()
+	if err != nil {
+		return r.evalError("luaRefund", err)
+	}
+	return nil
 }
 
-// currentTick returns the current time tick, measured
-// from b.startTime.
-func (r *redisBucket) currentTick(now time.Time, bucketInfo map[string]string) int64 {
-	startTime, _ := strconv.Atoi(bucketInfo[startTimeField])
-	fillInterval, _ := strconv.Atoi(bucketInfo[fillIntervalField])
+func (r *redisBucket) evalAllow(now time.Time, count int64) (Decision, error) {
+	// Execute lua script, EVALSHA falls back to EVAL on NOSCRIPT
+	res, err := algorithmScripts[r.algorithm].allow.Run(
+		r.Client,
+		[]string{r.Key},
+		r.args(now, count)...,
+	).Result()
+	if err != nil {
+		return Decision{}, r.evalError("luaAllow", err)
+	}
 
-	return (now.UnixNano() - int64(startTime)) / int64(fillInterval)
+	v := res.([]interface{})
+	d := Decision{
+		Allowed:    v[0].(int64) == 1,
+		Granted:    v[1].(int64),
+		Remaining:  v[2].(int64),
+		Limit:      v[3].(int64),
+		ResetAfter: time.Duration(v[4].(int64)) * r.timeUnit(),
+		RetryAfter: time.Duration(v[5].(int64)) * r.timeUnit(),
+	}
+	// The tokens exceed the capacity
+	if v[5].(int64) < 0 {
+		d.RetryAfter = infinityDuration
+	}
+	return d, nil
 }
 
-// adjustAvail adjusts the current number of tokens
-// available in the memoryBucket at the given time, which must
-// be in the future (positive) with respect to b.latestTick.
-func (r *redisBucket) adjustAvail(tick int64, bucketInfo map[string]string) (availInt64 int64, latestTickInt64 int64) {
-	avail, _ := strconv.Atoi(bucketInfo[availField])
-	capacity, _ := strconv.Atoi(bucketInfo[capacityField])
-	latestTick, _ := strconv.Atoi(bucketInfo[latestTickField])
-	quantum, _ := strconv.Atoi(bucketInfo[quantumField])
+// evalLease takes at least need and at most want tokens from the
+// bucket, or nothing if less than need tokens are available.
+func (r *redisBucket) evalLease(now time.Time, need, want int64) (int64, error) {
+	if want <= 0 {
+		return 0, nil
+	}
+
+	// Execute lua script, EVALSHA falls back to EVAL on NOSCRIPT
+	res, err := scriptLease.Run(
+		r.Client,
+		[]string{r.Key},
+		r.args(now, need, want)...,
+	).Result()
+	if err != nil {
+		return 0, r.evalError("luaLease", err)
+	}
+
+	return res.(int64), nil
+}
 
-	latestTickInt64 = tick
-	if avail >= capacity {
-		availInt64 = int64(avail)
-		return
+// args returns the arguments of the lua scripts: the current time and
+// the parameters of the bucket, followed by extra.
+func (r *redisBucket) args(now time.Time, extra ...interface{}) []interface{} {
+	var args []interface{}
+	switch r.algorithm {
+	case TokenBucket:
+		args = []interface{}{
+			r.storage.timeArg(now.UnixNano()),
+			strconv.FormatInt(r.fillInterval.Nanoseconds(), 10),
+			r.capacity,
+			r.quantum,
+			r.storage.expireArg(),
+			boolArg(r.continuous),
+		}
+	case GCRA:
+		interval := gcraInterval(r.fillInterval, r.quantum)
+		args = []interface{}{
+			r.storage.timeArg(now.UnixNano()),
+			strconv.FormatInt(int64(interval), 10),
+			strconv.FormatInt(r.capacity*int64(interval), 10),
+		}
+	case SlidingWindowLog:
+		window := windowOf(r.fillInterval, r.capacity, r.quantum)
+		args = []interface{}{
+			r.storage.timeArg(now.UnixNano() / int64(time.Microsecond)),
+			strconv.FormatInt(int64((window+time.Microsecond-1)/time.Microsecond), 10),
+			r.capacity,
+		}
+	case SlidingWindowCounter:
+		window := int64(windowOf(r.fillInterval, r.capacity, r.quantum))
+		t := now.UnixNano()
+		args = []interface{}{
+			r.storage.timeArg(t / window),
+			r.storage.timeArg(t % window),
+			strconv.FormatInt(window, 10),
+			r.capacity,
+		}
 	}
-	avail += (int(tick) - latestTick) * quantum
-	if avail > capacity {
-		avail = capacity
+	return append(args, extra...)
+}
+
+// timeUnit returns the unit of the durations in the scripts.
+func (r *redisBucket) timeUnit() time.Duration {
+	if r.algorithm == SlidingWindowLog {
+		return time.Microsecond
 	}
+	return time.Nanosecond
+}
 
-	availInt64 = int64(avail)
-	latestTickInt64 = tick
-	return
+// evalError translates the error of a lua script into one of the
+// sentinel errors of the package.
+func (r *redisBucket) evalError(script string, err error) error {
+	// The scripts return nil when the bucket does not exist.
+	if err == redis.Nil {
+		return fmt.Errorf("%w: %s", ErrBucketNotFound, r.Key)
+	}
+	return fmt.Errorf("%w: eval %s: %v", ErrStorageUnavailable, script, err)
 }
 
 // RedisStorage is a redisBucket factory.
+//
+// The Client may be a *redis.Client, a *redis.Ring, a *redis.ClusterClient
+// or any other redis.UniversalClient, e.g. a failover client for a
+// Sentinel-managed deployment. Each bucket is stored in a single hash
+// under its key, so it always lives in one slot of a Redis Cluster.
 type RedisStorage struct {
-	Client *redis.Client
+	Client redis.UniversalClient
+	// Expire holds the TTL of the buckets, it is refreshed every time a
+	// bucket is used. Zero means the time it takes to refill a bucket from
+	// its tokens plus a margin, tokens booked in advance included: an idle
+	// bucket has refilled by then, so it is identical to the fresh bucket
+	// created on next use. Negative means the buckets never expire. A TTL
+	// shorter than the refill time resets the buckets of the idle users
+	// early, and lets the buckets in debt forget the booked tokens.
 	Expire time.Duration
+	// Policy decides how the buckets behave when Redis fails,
+	// it defaults to FailOpen.
+	Policy FailurePolicy
+	// OnFailure is called, if not nil, whenever the Policy kicks in, and
+	// with ErrPermitLost when the lease of a held permit is lost.
+	OnFailure FailureFunc
+	// Conflict decides what Create does when the bucket already exists
+	// with other parameters, it defaults to ConflictError.
+	Conflict ConflictPolicy
+	// Algorithm selects how the buckets count their tokens, it defaults
+	// to TokenBucket. The other buckets expire once they are full again,
+	// Expire and Conflict only apply to token buckets.
+	Algorithm Algorithm
+	// PermitTTL holds the lease of the permits of the concurrency limiters,
+	// the permits of a crashed process are freed when it ends. The leases
+	// are renewed every PermitTTL/3 while held. Zero means 10 seconds,
+	// otherwise it must be at least a millisecond.
+	PermitTTL time.Duration
+	// ServerTime makes the scripts read the clock of Redis, rather than
+	// take the time of the client, so that the skew of the clocks of the
+	// clients doesn't matter. The scripts are then replicated by effects,
+	// which needs Redis 3.2 or later. The quotas read the clock of Redis
+	// with TIME to find their period.
+	ServerTime bool
 }
 
 // NewRedisStorage initializes the in-memory redisBucket store.
-func NewRedisStorage(client *redis.Client, expire time.Duration) *RedisStorage {
-	return &RedisStorage{
+func NewRedisStorage(client redis.UniversalClient, expire time.Duration) *RedisStorage {
+	r := &RedisStorage{
 		Expire: expire,
 		Client: client,
 	}
+	// Redis may not be ready yet, the scripts are loaded on first use then.
+	r.Preload()
+	return r
 }
 
 func (r *RedisStorage) Ping() error {
 	return r.Client.Ping().Err()
 }
 
+// Preload loads the lua scripts into the script cache of Redis, so that
+// the buckets can run them with EVALSHA. The scripts are reloaded
+// automatically when Redis forgets them, e.g. after a restart.
+func (r *RedisStorage) Preload() error {
+	for _, s := range scripts {
+		if err := s.Load(r.Client).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Create create a redisBucket.
 func (r *RedisStorage) Create(key string, fillInterval time.Duration, capacity int64) (Bucket, error) {
-	// ensure our redis connection is valid
-	if err := r.Ping(); err != nil {
-		return nil, err
-	}
-	// if bucket aready exist
-	if r.Client.Exists(key).Val() == 1 {
-		return &redisBucket{Key: key, Client: r.Client}, nil
+	return r.CreateWithQuantum(key, fillInterval, capacity, 1)
+}
+
+// CreateWithQuantum create a redisBucket with quantum.
+// If Redis fails, the Policy is applied: FailClosed returns the error,
+// the other policies still return the bucket and are applied on every
+// call. If the bucket already exists with other parameters, the Conflict
+// policy is applied.
+func (r *RedisStorage) CreateWithQuantum(key string, fillInterval time.Duration, capacity int64, quantum int64) (Bucket, error) {
+	return r.createBucket(r.newBucket(key, fillInterval, capacity, quantum))
+}
+
+// CreateWithRate create a redisBucket refilled continuously with
+// ratePerSecond tokens per second, see Storage. The other algorithms
+// get the fillInterval and quantum of the rate.
+func (r *RedisStorage) CreateWithRate(key string, ratePerSecond float64, capacity int64) (Bucket, error) {
+	fillInterval, quantum := rateOf(ratePerSecond)
+	b := r.newBucket(key, fillInterval, capacity, quantum)
+	b.continuous = b.algorithm == TokenBucket
+	return r.createBucket(b)
+}
+
+// createBucket stores the new bucket b in Redis and returns it.
+func (r *RedisStorage) createBucket(b *redisBucket) (Bucket, error) {
+	if b.algorithm != TokenBucket {
+		// Nothing is stored until the bucket is used.
+		return b, nil
 	}
-	b, err := r.create(key, fillInterval, capacity, 1)
-	if err != nil {
-		return nil, err
+	if err := r.create(b); err != nil {
+		if err == ErrBucketConflict {
+			return nil, fmt.Errorf("%w: %s", err, b.Key)
+		}
+		if r.fail(b.Key, err) == FailClosed {
+			return nil, err
+		}
 	}
 	return b, nil
 }
 
-// CreateWithQuantum create a memoryBucket with quantum.
-func (r *RedisStorage) CreateWithQuantum(key string, fillInterval time.Duration, capacity int64, quantum int64) (Bucket, error) {
-	// ensure our redis connection is valid
-	if err := r.Ping(); err != nil {
-		return nil, err
+// expireArg returns the argument of the scripts holding the TTL of the
+// buckets in milliseconds, 0 for none. By default it holds the negated
+// margin, the scripts add the time it takes to refill the bucket from
+// its tokens whenever they change.
+func (r *RedisStorage) expireArg() string {
+	if r.Expire < 0 {
+		return "0"
 	}
-	// If bucket aready exist
-	if r.Client.Exists(key).Val() == 1 {
-		return &redisBucket{Key: key, Client: r.Client}, nil
+	if r.Expire == 0 {
+		return strconv.FormatInt(-int64(defaultExpireMargin/time.Millisecond), 10)
 	}
-	b, err := r.create(key, fillInterval, capacity, quantum)
-	if err != nil {
-		return nil, err
+	return strconv.FormatInt(int64(r.Expire/time.Millisecond), 10)
+}
+
+// timeArg returns the argument of the scripts holding the time t,
+// or the empty argument making them read the clock of Redis.
+func (r *RedisStorage) timeArg(t int64) string {
+	if r.ServerTime {
+		return ""
 	}
-	return b, nil
+	return strconv.FormatInt(t, 10)
+}
+
+// boolArg returns the argument of the scripts holding b.
+func boolArg(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// fail reports err on the bucket key to OnFailure and returns the policy to apply.
+func (r *RedisStorage) fail(key string, err error) FailurePolicy {
+	if r.OnFailure != nil {
+		r.OnFailure(key, r.Policy, err)
+	}
+	return r.Policy
 }
 
-func (r *RedisStorage) create(key string, fillInterval time.Duration, capacity, quantum int64) (*redisBucket, error) {
+func (r *RedisStorage) newBucket(key string, fillInterval time.Duration, capacity, quantum int64) *redisBucket {
 	if fillInterval <= 0 {
 		panic("token bucket fill interval is not > 0")
 	}
@@ -227,22 +641,38 @@ func (r *RedisStorage) create(key string, fillInterval time.Duration, capacity,
 	if quantum <= 0 {
 		panic("token bucket quantum is not > 0")
 	}
+	return &redisBucket{
+		Key:          key,
+		Client:       r.Client,
+		storage:      r,
+		fillInterval: fillInterval,
+		capacity:     capacity,
+		quantum:      quantum,
+		algorithm:    r.Algorithm,
+		startTime:    time.Now(),
+	}
+}
 
-	err := r.Client.HMSet(key, map[string]interface{}{
-		startTimeField:    time.Now().UnixNano(),
-		latestTickField:   0,
-		fillIntervalField: fillInterval.Nanoseconds(),
-		capacityField:     capacity,
-		quantumField:      quantum,
-		availField:        capacity,
-	}).Err()
-	if err != nil {
-		return nil, err
+// create initializes the bucket in Redis if it does not exist yet,
+// in a single lua script so that concurrent creations don't reset
+// each other and the key never lives without its TTL.
+func (r *RedisStorage) create(b *redisBucket) error {
+	update := "0"
+	if r.Conflict == ConflictUpdate {
+		update = "1"
 	}
-	r.Client.Expire(key, r.Expire)
 
-	return &redisBucket{
-		Key:    key,
-		Client: r.Client,
-	}, nil
+	// Execute lua script, EVALSHA falls back to EVAL on NOSCRIPT
+	res, err := scriptCreate.Run(
+		r.Client,
+		[]string{b.Key},
+		b.args(time.Now(), update)...,
+	).Result()
+	if err != nil {
+		return fmt.Errorf("%w: eval luaCreate: %v", ErrStorageUnavailable, err)
+	}
+	if res.(int64) < 0 {
+		return ErrBucketConflict
+	}
+	return nil
 }
@@ -1,8 +1,9 @@
 package tkbucket
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"math"
 	"testing"
 	"time"
 
@@ -10,13 +11,13 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-const (
-	estimateVal  = 500
-	bucketExpire = 3 * time.Hour
-)
+const bucketExpire = 3 * time.Hour
 
 var redisClient = redis.NewClient(&redis.Options{Addr: ":6379"})
 
+// downClient points to an address where no Redis is listening.
+var downClient = redis.NewClient(&redis.Options{Addr: ":1"})
+
 //------------------------------------Acquire Test------------------------------------------
 func TestRedisAcquire(t *testing.T) {
 	asserts := assert.New(t)
@@ -73,15 +74,364 @@ func TestRedisTryAcquire(t *testing.T) {
 		for j, req := range test.reqs {
 			d, ok := tb.tryAcquire(tb.StartTime().Add(req.time), req.count, infinityDuration)
 			asserts.Equal(ok, true, fmt.Sprintf("unexpect: waitTime > maxWait(%v)", infinityDuration))
-			abs := math.Abs(float64(d.Nanoseconds() - req.expectWait.Nanoseconds()))
-			if abs > estimateVal {
-				asserts.Equal(d, req.expectWait, fmt.Sprintf("test %d.%d, %s, got %v want %v, abs(%v) exceed estimate", i, j, test.about, d, req.expectWait, abs))
-			}
+			asserts.Equal(req.expectWait, d, fmt.Sprintf("test %d.%d, %s, got %v want %v", i, j, test.about, d, req.expectWait))
 		}
 		fmt.Println("TryAcquireTest:", test.about, "-> success")
 	}
 }
 
+//------------------------------------Wait Test------------------------------------------
+func TestRedisWaitContext(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	// NOTE: Reset data
+	nrs.Client.FlushDB()
+
+	tb, err := nrs.Create("msf_token_bucket", 200*time.Millisecond, 1)
+	asserts.Nil(err, "Token bucket create failed")
+	asserts.Nil(tb.WaitContext(context.Background(), 1), "tokens are available")
+
+	// The deadline is before the token arrives, nothing should be taken.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	asserts.Equal(ErrWaitTooLong, tb.WaitContext(ctx, 1))
+	asserts.Equal(false, tb.WaitMaxDuration(1, 50*time.Millisecond))
+
+	// Cancel while waiting, the reserved token must be given back.
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	asserts.Equal(context.Canceled, tb.WaitContext(ctx, 1))
+	d := tb.TryAcquire(1)
+	asserts.True(d > 0 && d <= 200*time.Millisecond, fmt.Sprintf("got wait %v after refund", d))
+	fmt.Println("WaitContextTest: -> success")
+}
+
+//------------------------------------Reserve Test------------------------------------------
+func TestRedisReserve(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	// NOTE: Reset data
+	nrs.Client.FlushDB()
+
+	tb, err := nrs.Create("msf_token_bucket", 250*time.Millisecond, 10)
+	asserts.Nil(err, "Token bucket create failed")
+
+	start := tb.StartTime()
+	r := reserve(tb, start, 10, infinityDuration)
+	asserts.True(r.OK())
+	asserts.Equal(time.Duration(0), r.DelayFrom(start))
+
+	r = reserve(tb, start, 2, infinityDuration)
+	asserts.True(r.OK())
+	asserts.Equal(500*time.Millisecond, r.DelayFrom(start))
+
+	// Too long to wait, nothing is taken.
+	asserts.False(reserve(tb, start, 1, 100*time.Millisecond).OK())
+
+	r.CancelAt(start.Add(100 * time.Millisecond))
+	r.CancelAt(start.Add(100 * time.Millisecond))
+	asserts.Equal(int64(1), tb.available(start.Add(250*time.Millisecond)))
+	fmt.Println("ReserveTest: -> success")
+}
+
+//------------------------------------Error Test------------------------------------------
+func TestRedisErrors(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	// NOTE: Reset data
+	nrs.Client.FlushDB()
+
+	tb, err := nrs.Create("msf_token_bucket", time.Second, 1)
+	asserts.Nil(err, "Token bucket create failed")
+	n, err := tb.AcquireE(1)
+	asserts.Nil(err)
+	asserts.Equal(int64(1), n)
+	_, err = tb.TryAcquireE(1)
+	asserts.Nil(err)
+
+	// Redis can not be reached.
+	down, _ := NewRedisStorage(downClient, bucketExpire).Create("msf_token_bucket", time.Second, 1)
+	_, err = down.AcquireE(1)
+	asserts.True(errors.Is(err, ErrStorageUnavailable), fmt.Sprintf("got %v", err))
+	_, err = down.TryAcquireE(1)
+	asserts.True(errors.Is(err, ErrStorageUnavailable), fmt.Sprintf("got %v", err))
+	_, err = down.AvailableE()
+	asserts.True(errors.Is(err, ErrStorageUnavailable), fmt.Sprintf("got %v", err))
+	// The parameters of the handle are returned rather than zeros.
+	asserts.Equal(int64(1), down.Capacity())
+	asserts.True(down.StartTime().After(time.Unix(0, 0)))
+	fmt.Println("ErrorsTest: -> success")
+}
+
+func TestRedisLazyCreate(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	// NOTE: Reset data
+	nrs.Client.FlushDB()
+
+	tb, err := nrs.Create("msf_token_bucket", time.Hour, 2)
+	asserts.Nil(err, "Token bucket create failed")
+	asserts.Equal(int64(2), tb.Acquire(3))
+
+	// The bucket is gone, e.g. expired, it comes back full on first use.
+	scripts := []func() error{
+		func() error { _, err := tb.AcquireE(1); return err },
+		func() error { _, err := tb.TryAcquireE(1); return err },
+		func() error { _, err := tb.AvailableE(); return err },
+		func() error { return tb.WaitContext(context.Background(), 1) },
+	}
+	for i, script := range scripts {
+		nrs.Client.Del("msf_token_bucket")
+		asserts.Nil(script(), fmt.Sprintf("script %d", i))
+		asserts.Equal("2", nrs.Client.HGet("msf_token_bucket", capacityField).Val(), fmt.Sprintf("script %d", i))
+		ttl := nrs.Client.PTTL("msf_token_bucket").Val()
+		asserts.True(ttl > 0 && ttl <= bucketExpire, fmt.Sprintf("script %d, got ttl %v", i, ttl))
+	}
+	nrs.Client.Del("msf_token_bucket")
+	asserts.Equal(int64(2), tb.Capacity())
+	asserts.True(tb.StartTime().After(time.Unix(0, 0)))
+	asserts.Equal(int64(2), tb.Available())
+	fmt.Println("LazyCreateTest: -> success")
+}
+
+//------------------------------------Create Test------------------------------------------
+func TestRedisCreate(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	// NOTE: Reset data
+	nrs.Client.FlushDB()
+
+	tb, err := nrs.Create("msf_token_bucket", time.Second, 10)
+	asserts.Nil(err, "Token bucket create failed")
+	ttl := nrs.Client.PTTL("msf_token_bucket").Val()
+	asserts.True(ttl > 0 && ttl <= bucketExpire, fmt.Sprintf("got ttl %v", ttl))
+	asserts.Equal(int64(5), tb.acquire(tb.StartTime(), 5))
+
+	// Creating an existing bucket does not reset it.
+	tb2, err := nrs.Create("msf_token_bucket", time.Second, 10)
+	asserts.Nil(err, "Token bucket create failed")
+	asserts.Equal(int64(5), tb2.available(tb.StartTime()))
+
+	// Other parameters are refused by default.
+	_, err = nrs.CreateWithQuantum("msf_token_bucket", time.Second, 10, 2)
+	asserts.True(errors.Is(err, ErrBucketConflict), fmt.Sprintf("got %v", err))
+	_, err = nrs.Create("msf_token_bucket", time.Second, 3)
+	asserts.True(errors.Is(err, ErrBucketConflict), fmt.Sprintf("got %v", err))
+
+	// Or applied to the existing bucket, keeping its tokens up to the capacity.
+	nrs.Conflict = ConflictUpdate
+	tb3, err := nrs.Create("msf_token_bucket", time.Second, 3)
+	asserts.Nil(err, "Token bucket update failed")
+	asserts.Equal(int64(3), tb3.Capacity())
+	asserts.Equal(int64(3), tb3.available(tb3.StartTime()))
+	asserts.Equal(int64(3), tb.Capacity())
+	fmt.Println("CreateTest: -> success")
+}
+
+//------------------------------------Expire Test------------------------------------------
+func TestRedisExpire(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(redisClient, 0)
+	// NOTE: Reset data
+	nrs.Client.FlushDB()
+
+	// The default TTL is the time to refill the bucket plus a margin,
+	// a full bucket expires after the margin.
+	tb, err := nrs.CreateWithQuantum("msf_token_bucket", time.Second, 10, 3)
+	asserts.Nil(err, "Token bucket create failed")
+	ttl := nrs.Client.PTTL("msf_token_bucket").Val()
+	asserts.True(ttl > defaultExpireMargin-time.Second && ttl <= defaultExpireMargin, fmt.Sprintf("got ttl %v", ttl))
+
+	// The tokens booked in advance are refilled before the bucket expires.
+	tb.TryAcquire(16)
+	want := 6*time.Second + defaultExpireMargin
+	ttl = nrs.Client.PTTL("msf_token_bucket").Val()
+	asserts.True(ttl > want-time.Second && ttl <= want, fmt.Sprintf("got ttl %v", ttl))
+
+	// Every use refreshes the TTL.
+	nrs.Client.PExpire("msf_token_bucket", time.Second)
+	tb.Available()
+	ttl = nrs.Client.PTTL("msf_token_bucket").Val()
+	asserts.True(ttl > want-time.Second && ttl <= want, fmt.Sprintf("got ttl %v", ttl))
+
+	// The TTL is configurable.
+	nrs.Expire = bucketExpire
+	tb.Acquire(1)
+	ttl = nrs.Client.PTTL("msf_token_bucket").Val()
+	asserts.True(ttl > bucketExpire-time.Second && ttl <= bucketExpire, fmt.Sprintf("got ttl %v", ttl))
+
+	// Or disabled.
+	nrs.Expire = -1
+	nrs.Client.Del("msf_token_bucket")
+	tb.Acquire(1)
+	asserts.True(nrs.Client.PTTL("msf_token_bucket").Val() < 0, "bucket should not expire")
+
+	// A bucket which takes forever to refill never expires.
+	nrs.Expire = 0
+	tb, err = nrs.Create("msf_token_bucket_forever", infinityDuration/2, 10)
+	asserts.Nil(err, "Token bucket create failed")
+	asserts.True(nrs.Client.PTTL("msf_token_bucket_forever").Val() > 0, "a full bucket expires")
+	asserts.Equal(int64(10), tb.Acquire(10))
+	asserts.True(nrs.Client.PTTL("msf_token_bucket_forever").Val() < 0, "bucket should not expire")
+	fmt.Println("ExpireTest: -> success")
+}
+
+//------------------------------------Topology Test------------------------------------------
+// testTopology runs the acquire tests against a redis client of any topology.
+func testTopology(t *testing.T, client redis.UniversalClient) {
+	asserts := assert.New(t)
+
+	for i, test := range acquire1Tests {
+		nrs := NewRedisStorage(client, bucketExpire)
+		key := fmt.Sprintf("msf_token_bucket_:%s:%d", t.Name(), i)
+		client.Del(key)
+
+		tb, err := nrs.CreateWithQuantum(key, test.fillInterval, test.capacity, test.quantum)
+		asserts.Nil(err, "Token bucket create failed")
+
+		for j, req := range test.reqs {
+			d, err := tb.(*redisBucket).evalAcquire(tb.StartTime().Add(req.time), req.count)
+			asserts.Nil(err)
+			asserts.Equal(d, req.expect, fmt.Sprintf("test %d.%d, %s, got %v want %v", i, j, test.about, d, req.expect))
+		}
+		fmt.Println("TopologyTests:", t.Name(), test.about, "-> success")
+	}
+}
+
+func TestRedisTopology(t *testing.T) {
+	t.Run("Client", func(t *testing.T) {
+		testTopology(t, redisClient)
+	})
+
+	t.Run("Universal", func(t *testing.T) {
+		client := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+		defer client.Close()
+		testTopology(t, client)
+	})
+
+	t.Run("Ring", func(t *testing.T) {
+		// Two shards on the local Redis stand in for two servers.
+		client := redis.NewRing(&redis.RingOptions{
+			Addrs: map[string]string{"shard1": ":6379", "shard2": ":6379"},
+		})
+		defer client.Close()
+		testTopology(t, client)
+	})
+
+	t.Run("Cluster", func(t *testing.T) {
+		client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{":6379"}})
+		defer client.Close()
+		if err := client.Ping().Err(); err != nil {
+			t.Skipf("local Redis does not run in cluster mode: %v", err)
+		}
+		testTopology(t, client)
+	})
+
+	t.Run("Sentinel", func(t *testing.T) {
+		sentinel := redis.NewClient(&redis.Options{Addr: ":26379"})
+		defer sentinel.Close()
+		if err := sentinel.Ping().Err(); err != nil {
+			t.Skipf("no local Sentinel: %v", err)
+		}
+		client := redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    "mymaster",
+			SentinelAddrs: []string{":26379"},
+		})
+		defer client.Close()
+		testTopology(t, client)
+	})
+}
+
+//------------------------------------Script Test------------------------------------------
+func TestRedisScriptCache(t *testing.T) {
+	asserts := assert.New(t)
+
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	// NOTE: Reset data
+	nrs.Client.FlushDB()
+	nrs.Client.ScriptFlush()
+
+	asserts.Nil(nrs.Preload())
+	hashes := make([]string, len(scripts))
+	for i, s := range scripts {
+		hashes[i] = s.Hash()
+	}
+	exists, err := nrs.Client.ScriptExists(hashes...).Result()
+	asserts.Nil(err)
+	for i, ok := range exists {
+		asserts.True(ok, fmt.Sprintf("script %d is not loaded", i))
+	}
+
+	// Redis forgets the scripts, e.g. after a restart.
+	nrs.Client.ScriptFlush()
+	tb, err := nrs.Create("msf_token_bucket", time.Second, 10)
+	asserts.Nil(err, "Token bucket create failed")
+	n, err := tb.AcquireE(1)
+	asserts.Nil(err)
+	asserts.Equal(int64(1), n)
+	exists, _ = nrs.Client.ScriptExists(scriptAcquire.Hash()).Result()
+	asserts.Equal([]bool{true}, exists, "script is reloaded")
+	fmt.Println("ScriptCacheTest: -> success")
+}
+
+//------------------------------------FailurePolicy Test------------------------------------------
+func TestRedisFailurePolicy(t *testing.T) {
+	asserts := assert.New(t)
+
+	var failures int
+	nrs := NewRedisStorage(downClient, bucketExpire)
+	nrs.OnFailure = func(key string, policy FailurePolicy, err error) {
+		asserts.Equal("msf_token_bucket", key)
+		asserts.True(errors.Is(err, ErrStorageUnavailable), fmt.Sprintf("got %v", err))
+		failures++
+	}
+
+	// Redis is down, the bucket is created anyway.
+	tb, err := nrs.Create("msf_token_bucket", time.Second, 2)
+	asserts.Nil(err)
+	asserts.Equal(1, failures)
+
+	nrs.Policy = FailOpen
+	asserts.Equal(int64(5), tb.Acquire(5))
+	asserts.Equal(time.Duration(0), tb.TryAcquire(5))
+	asserts.Equal(int64(2), tb.Available())
+	asserts.Nil(tb.WaitContext(context.Background(), 5))
+	fmt.Println("FailurePolicyTest: fail-open -> success")
+
+	nrs.Policy = FailClosed
+	asserts.Equal(int64(0), tb.Acquire(1))
+	asserts.Equal(infinityDuration, tb.TryAcquire(1))
+	asserts.Equal(int64(0), tb.Available())
+	asserts.False(tb.Reserve(1).OK())
+	err = tb.WaitContext(context.Background(), 1)
+	asserts.True(errors.Is(err, ErrStorageUnavailable), fmt.Sprintf("got %v", err))
+	fmt.Println("FailurePolicyTest: fail-closed -> success")
+
+	nrs.Policy = FailLocal
+	asserts.Equal(int64(2), tb.Available())
+	asserts.Equal(int64(1), tb.Acquire(1))
+	asserts.Equal(int64(1), tb.Acquire(5))
+	asserts.Equal(int64(0), tb.Acquire(1))
+	asserts.True(tb.TryAcquire(1) > 0)
+	fmt.Println("FailurePolicyTest: fail-local -> success")
+
+	nrs.Policy = FailClosed
+	_, err = nrs.Create("msf_token_bucket", time.Second, 2)
+	asserts.True(errors.Is(err, ErrStorageUnavailable), fmt.Sprintf("got %v", err))
+	fmt.Println("FailurePolicyTest: fail-closed create -> success")
+
+	asserts.Equal(16, failures)
+}
+
 func TestRedisPanics(t *testing.T) {
 	asserts := assert.New(t)
 
@@ -110,6 +460,62 @@ func TestRedisPanics(t *testing.T) {
 	}, "token bucket quantum is not > 0")
 }
 
+//------------------------------------ServerTime Test------------------------------------------
+func TestRedisServerTime(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, algorithm := range []Algorithm{TokenBucket, GCRA, SlidingWindowLog, SlidingWindowCounter} {
+		nrs := NewRedisStorage(redisClient, bucketExpire)
+		nrs.Client.FlushDB()
+		nrs.Algorithm = algorithm
+		nrs.ServerTime = true
+		tb, err := nrs.Create("msf_server_time", time.Hour, 2)
+		asserts.Nil(err, "Bucket create failed")
+
+		// The clock of the client is ahead, the bucket is not refilled.
+		skewed := time.Now().Add(10 * time.Hour)
+		asserts.Equal(int64(2), tb.acquire(skewed, 2), algorithm.String())
+		asserts.Equal(int64(0), tb.available(skewed.Add(10*time.Hour)), algorithm.String())
+		d, err := tb.tryAcquireE(skewed, 1, infinityDuration)
+		asserts.Nil(err, algorithm.String())
+		if algorithm == TokenBucket || algorithm == GCRA {
+			asserts.True(d > 59*time.Minute && d <= time.Hour, fmt.Sprint(algorithm, " wait ", d))
+		}
+		if algorithm == TokenBucket {
+			asserts.WithinDuration(time.Now(), tb.StartTime(), time.Second, "start time of the Redis clock")
+		}
+		fmt.Println("RedisServerTimeTest:", algorithm, "-> success")
+	}
+
+	// The leases of the permits follow the clock of Redis too.
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	nrs.Client.FlushDB()
+	nrs.ServerTime = true
+	cs, _ := nrs.CreateConcurrency("msf_server_time", 1)
+	c := cs.(*redisConcurrency)
+	_, err := c.evalAcquire(time.Now().Add(-time.Hour))
+	asserts.Nil(err)
+	asserts.Equal(int64(1), c.InFlight())
+	_, err = c.evalAcquire(time.Now().Add(time.Hour))
+	asserts.Equal(ErrNoPermit, err)
+	fmt.Println("RedisServerTimeTest: concurrency -> success")
+
+	// The quotas count the calls in the period of the clock of Redis.
+	qs, _ := nrs.CreateQuota("msf_server_time", Daily, 10, time.UTC)
+	q := qs.(*redisQuota)
+	skewed := time.Now().Add(48 * time.Hour)
+	n, err := q.acquireE(skewed, 3)
+	asserts.Nil(err)
+	asserts.Equal(int64(3), n)
+	key, end := q.periodKey(time.Now())
+	asserts.Equal("3", nrs.Client.Get(key).Val(), "key of the period of Redis")
+	asserts.Equal(end, q.resetAt(skewed))
+	remaining, err := q.remainingE(skewed)
+	asserts.Nil(err)
+	asserts.Equal(int64(7), remaining)
+	fmt.Println("RedisServerTimeTest: quota -> success")
+}
+
 //------------------------------------Benchmark------------------------------------------
 func BenchmarkRedisWait(b *testing.B) {
 	nrs := NewRedisStorage(redisClient, bucketExpire)
@@ -0,0 +1,95 @@
+package tkbucket
+
+import (
+	"sync"
+	"time"
+)
+
+// Reservation holds information about tokens that are reserved
+// from a bucket and may be used after a delay.
+type Reservation struct {
+	bucket Bucket
+	ok     bool
+	// err holds why the reservation is not OK.
+	err   error
+	count int64
+	// timeToAct holds the moment when the reserved tokens
+	// become available.
+	timeToAct time.Time
+	// mu guards canceled.
+	mu       sync.Mutex
+	canceled bool
+}
+
+// reserve books count tokens from b, waiting no longer than maxWait.
+func reserve(b Bucket, now time.Time, count int64, maxWait time.Duration) *Reservation {
+	d, err := b.tryAcquireE(now, count, maxWait)
+	r := &Reservation{
+		bucket: b,
+		ok:     err == nil,
+		err:    err,
+	}
+	if r.ok && count > 0 {
+		r.count = count
+		r.timeToAct = now.Add(d)
+	}
+	return r
+}
+
+// OK returns whether the bucket can provide the requested number
+// of tokens within the maximum wait time.
+// If OK is false, Delay returns infinityDuration, and Cancel does nothing.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Err returns why the reservation is not OK: ErrWaitTooLong,
+// or the error of the storage.
+func (r *Reservation) Err() error {
+	return r.err
+}
+
+// Delay is shorthand for DelayFrom(time.Now()).
+func (r *Reservation) Delay() time.Duration {
+	return r.DelayFrom(time.Now())
+}
+
+// DelayFrom returns the duration for which the reservation holder must wait
+// before taking the reserved action. Zero duration means act immediately.
+func (r *Reservation) DelayFrom(now time.Time) time.Duration {
+	if !r.ok {
+		return infinityDuration
+	}
+	d := r.timeToAct.Sub(now)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// Cancel is shorthand for CancelAt(time.Now()).
+func (r *Reservation) Cancel() {
+	r.CancelAt(time.Now())
+}
+
+// CancelAt indicates that the reservation holder will not perform the
+// reserved action and gives the reserved tokens back to the bucket,
+// as long as they are not consumed by time yet (now is before the
+// moment the tokens become available).
+func (r *Reservation) CancelAt(now time.Time) {
+	if !r.ok || r.count == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.canceled || !now.Before(r.timeToAct) {
+		return
+	}
+	if err := r.bucket.refund(now, r.timeToAct, r.count); err != nil {
+		// Keep the reservation so that the cancel can be retried.
+		return
+	}
+	r.canceled = true
+}
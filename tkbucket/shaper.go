@@ -0,0 +1,95 @@
+package tkbucket
+
+import (
+	"context"
+	"time"
+)
+
+// Shaper is a leaky bucket used as a queue: the requests are released one
+// at a time at a constant rate, and wait for their slot in a queue of
+// bounded length. Unlike a Bucket, it never lets a burst through.
+//
+// The queue is not kept anywhere, the slots are booked in a bucket of
+// capacity 1 refilled every interval, so a Shaper can be shared between
+// processes with a RedisStorage.
+type Shaper struct {
+	bucket Bucket
+	// interval holds the time between two releases.
+	interval time.Duration
+	// maxQueue holds the number of requests which may wait for their slot.
+	maxQueue int64
+}
+
+// NewShaper creates a Shaper releasing a request every interval, with up to
+// maxQueue requests waiting. Its bucket is created in storage with name.
+func NewShaper(storage Storage, name string, interval time.Duration, maxQueue int64) (*Shaper, error) {
+	if maxQueue < 0 {
+		panic("shaper max queue is < 0")
+	}
+	b, err := storage.Create(name, interval, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &Shaper{
+		bucket:   b,
+		interval: interval,
+		maxQueue: maxQueue,
+	}, nil
+}
+
+// Interval returns the time between two releases.
+func (s *Shaper) Interval() time.Duration {
+	return s.interval
+}
+
+// MaxQueue returns the number of requests which may wait for their slot.
+func (s *Shaper) MaxQueue() int64 {
+	return s.maxQueue
+}
+
+// Enqueue waits for the slot of the request. It returns ErrQueueFull if
+// maxQueue requests are waiting already, and ErrWaitTooLong if the slot is
+// after the deadline of ctx, without taking a slot in both cases. The slot
+// of a request canceled while waiting is not given to another one, so the
+// rate is never exceeded.
+func (s *Shaper) Enqueue(ctx context.Context) error {
+	// Don't take a slot if the ctx is already done.
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	now := time.Now()
+	untilDeadline := infinityDuration
+	if deadline, ok := ctx.Deadline(); ok {
+		untilDeadline = deadline.Sub(now)
+	}
+	d, err := s.slot(now, untilDeadline)
+	if err != nil || d <= 0 {
+		return err
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// slot books the next slot at now and returns how long to wait for it.
+func (s *Shaper) slot(now time.Time, untilDeadline time.Duration) (time.Duration, error) {
+	// The last request in the queue waits maxQueue intervals.
+	maxWait := time.Duration(s.maxQueue) * s.interval
+	if untilDeadline < maxWait {
+		maxWait = untilDeadline
+	}
+	d, err := s.bucket.tryAcquireE(now, 1, maxWait)
+	if err == ErrWaitTooLong && maxWait != untilDeadline {
+		return 0, ErrQueueFull
+	}
+	return d, err
+}
@@ -0,0 +1,77 @@
+package tkbucket
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//------------------------------------Shaper Test------------------------------------------
+func TestShaperSlot(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, test := range []struct {
+		kind      string
+		algorithm Algorithm
+	}{
+		{"memory", TokenBucket},
+		{"memory", GCRA},
+		{"redis", TokenBucket},
+		{"redis", GCRA},
+	} {
+		kind := fmt.Sprint(test.kind, " ", test.algorithm)
+		s, err := NewShaper(newStorage(test.kind, test.algorithm), "msf_shaper", 100*time.Millisecond, 2)
+		asserts.Nil(err, "Shaper create failed")
+
+		// The requests are released one by one, two of them may wait.
+		start := s.bucket.StartTime()
+		for i, want := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond} {
+			d, err := s.slot(start, infinityDuration)
+			asserts.Nil(err, kind)
+			asserts.Equal(want, d, fmt.Sprintf("%s request %d", kind, i))
+		}
+		_, err = s.slot(start, infinityDuration)
+		asserts.Equal(ErrQueueFull, err, kind)
+
+		// The slot is after the deadline.
+		_, err = s.slot(start.Add(250*time.Millisecond), 10*time.Millisecond)
+		asserts.Equal(ErrWaitTooLong, err, kind)
+
+		d, err := s.slot(start.Add(250*time.Millisecond), infinityDuration)
+		asserts.Nil(err, kind)
+		asserts.Equal(50*time.Millisecond, d, kind)
+		fmt.Println("ShaperSlotTest:", kind, "-> success")
+	}
+}
+
+func TestShaperEnqueue(t *testing.T) {
+	asserts := assert.New(t)
+
+	s, err := NewShaper(NewMemoryStorage(), "msf_shaper", 50*time.Millisecond, 1)
+	asserts.Nil(err, "Shaper create failed")
+
+	start := time.Now()
+	asserts.Nil(s.Enqueue(context.Background()))
+	asserts.Nil(s.Enqueue(context.Background()))
+	asserts.True(time.Since(start) >= 40*time.Millisecond, "the second request waits for its slot")
+
+	// The queue holds the second request, the third one is refused.
+	done := make(chan error)
+	go func() { done <- s.Enqueue(context.Background()) }()
+	time.Sleep(10 * time.Millisecond)
+	asserts.Equal(ErrQueueFull, s.Enqueue(context.Background()))
+	asserts.Nil(<-done)
+
+	// A canceled request gives up its slot.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	asserts.Equal(context.Canceled, s.Enqueue(ctx))
+	asserts.Equal(context.Canceled, s.Enqueue(ctx))
+	fmt.Println("ShaperEnqueueTest: -> success")
+}
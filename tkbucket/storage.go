@@ -1,10 +1,38 @@
 package tkbucket
 
 import (
+	"context"
+	"errors"
 	"time"
 )
 
-// Bucket interface for interacting with leaky buckets: https://en.wikipedia.org/wiki/Leaky_bucket
+var (
+	// ErrWaitTooLong is returned when the tokens cannot be obtained
+	// before the deadline of the wait.
+	ErrWaitTooLong = errors.New("tkbucket: wait exceeds deadline")
+	// ErrBucketNotFound is returned when the bucket does not exist
+	// in the storage, e.g. it has expired.
+	ErrBucketNotFound = errors.New("tkbucket: bucket not found")
+	// ErrStorageUnavailable is returned when the storage backing the
+	// bucket cannot be reached or fails to execute the request.
+	ErrStorageUnavailable = errors.New("tkbucket: storage unavailable")
+	// ErrBucketConflict is returned when a bucket is created with other
+	// parameters than the existing bucket of the same name.
+	ErrBucketConflict = errors.New("tkbucket: bucket exists with other parameters")
+	// ErrQueueFull is returned when a Shaper has too many
+	// requests waiting for their slot.
+	ErrQueueFull = errors.New("tkbucket: queue is full")
+	// ErrNoPermit is returned when all the permits of a
+	// ConcurrencyLimiter are held.
+	ErrNoPermit = errors.New("tkbucket: no permit available")
+	// ErrPermitLost is reported to RedisStorage.OnFailure when the lease
+	// of a held permit has ended, e.g. Redis has been flushed.
+	ErrPermitLost = errors.New("tkbucket: permit lease lost")
+)
+
+// Bucket interface for interacting with token buckets: https://en.wikipedia.org/wiki/Token_bucket
+// A bucket admits bursts up to its capacity, see Shaper for a leaky bucket
+// used as a queue: https://en.wikipedia.org/wiki/Leaky_bucket
 type Bucket interface {
 	// Acquire get the token from the bucket
 	// > 0 means that the token was obtained.
@@ -15,8 +43,37 @@ type Bucket interface {
 	// Wait try to acquire the token from the bucket
 	// If you can't get it, wait automatically until you get it.
 	Wait(count int64)
+	// WaitContext is like Wait, but returns early when ctx is done.
+	// If the tokens cannot be obtained before the deadline of ctx,
+	// it returns ErrWaitTooLong without taking any token. Tokens
+	// reserved by an aborted wait are returned to the bucket.
+	WaitContext(ctx context.Context, count int64) error
+	// WaitMaxDuration is like Wait except that it will
+	// only take tokens from the bucket if it needs to wait
+	// for no greater than maxWait. It reports whether
+	// any tokens have been removed from the bucket.
+	WaitMaxDuration(count int64, maxWait time.Duration) bool
+	// Reserve books count tokens from the bucket and returns a Reservation
+	// that tells how long to wait before using them. The reservation can be
+	// canceled to give back the tokens that are not consumed yet.
+	Reserve(count int64) *Reservation
 	// Available returns the number of available tokens.
 	Available() int64
+	// AcquireE is like Acquire, but returns an error instead of 0 when
+	// the bucket could not be read.
+	AcquireE(count int64) (int64, error)
+	// TryAcquireE is like TryAcquire, but returns an error when the
+	// bucket could not be read.
+	TryAcquireE(count int64) (time.Duration, error)
+	// AvailableE is like Available, but returns an error when the
+	// bucket could not be read.
+	AvailableE() (int64, error)
+	// Allow takes count tokens if they are all available, without waiting,
+	// and returns the Decision read with the tokens in a single step.
+	Allow(count int64) Decision
+	// AllowE is like Allow, but returns an error when the
+	// bucket could not be read.
+	AllowE(count int64) (Decision, error)
 	// StartTime to get startTime
 	StartTime() time.Time
 	// Capacity of the bucket.
@@ -27,6 +84,19 @@ type Bucket interface {
 	tryAcquire(now time.Time, count int64, maxWait time.Duration) (time.Duration, bool)
 	// available is the internal version - to enable easy testing.
 	available(now time.Time) int64
+	// acquireE is the internal version - to enable easy testing.
+	acquireE(now time.Time, count int64) (int64, error)
+	// tryAcquireE is the internal version - to enable easy testing.
+	tryAcquireE(now time.Time, count int64, maxWait time.Duration) (time.Duration, error)
+	// availableE is the internal version - to enable easy testing.
+	availableE(now time.Time) (int64, error)
+	// allow is the internal version - to enable easy testing.
+	allow(now time.Time, count int64) Decision
+	// allowE is the internal version - to enable easy testing.
+	allowE(now time.Time, count int64) (Decision, error)
+	// refund returns count reserved tokens to the bucket, which
+	// were available at at.
+	refund(now, at time.Time, count int64) error
 }
 
 // Storage interface for generating buckets keyed by a string.
@@ -37,4 +107,47 @@ type Storage interface {
 	Create(name string, fillInterval time.Duration, capacity int64) (Bucket, error)
 	// CreateWithQuantum a bucket with a name, fillInterval, capacity, and quantum.
 	CreateWithQuantum(name string, fillInterval time.Duration, capacity, quantum int64) (Bucket, error)
+	// CreateWithRate a bucket with a name, refilled continuously with
+	// ratePerSecond tokens per second, and capacity. The tokens arrive one
+	// at a time at the nanosecond rather than in steps of quantum, so 3
+	// tokens per second never drift like a fillInterval of 333ms. The rate
+	// is taken as the closest fraction of tokens per whole seconds, up to
+	// 100000 seconds, e.g. 1/3 is exactly one token every 3 seconds.
+	CreateWithRate(name string, ratePerSecond float64, capacity int64) (Bucket, error)
+}
+
+// Algorithm selects how the buckets of a Storage count their tokens.
+type Algorithm int
+
+const (
+	// TokenBucket refills the buckets with quantum tokens on every tick
+	// of fillInterval, the tokens and the latest tick are stored.
+	TokenBucket Algorithm = iota
+	// GCRA is the generic cell rate algorithm: the buckets refill continuously
+	// with one token every fillInterval/quantum, and only the theoretical
+	// arrival time (TAT) of the next request is stored. A full bucket stores
+	// nothing at all.
+	GCRA
+	// SlidingWindowLog admits at most capacity tokens in any rolling window,
+	// the window being the time a token bucket takes to refill:
+	// capacity*fillInterval/quantum. The time of every request is logged.
+	SlidingWindowLog
+	// SlidingWindowCounter approximates SlidingWindowLog with the counters
+	// of the current and the previous fixed windows, the previous one
+	// weighted by how much it overlaps the rolling window.
+	SlidingWindowCounter
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case TokenBucket:
+		return "token-bucket"
+	case GCRA:
+		return "gcra"
+	case SlidingWindowLog:
+		return "sliding-window-log"
+	case SlidingWindowCounter:
+		return "sliding-window-counter"
+	}
+	return "unknown"
 }
@@ -0,0 +1,24 @@
+package tkbucket
+
+// storageKinds are the kinds of the storages the tests run against.
+var storageKinds = []string{"memory", "redis"}
+
+// testStorage creates the buckets, the quotas and the concurrency limiters.
+type testStorage interface {
+	Storage
+	QuotaStorage
+	ConcurrencyStorage
+}
+
+// newStorage returns an empty storage of kind, creating
+// buckets counting their tokens with algorithm.
+func newStorage(kind string, algorithm Algorithm) testStorage {
+	if kind == "memory" {
+		return NewMemoryStorageWithOptions(MemoryOptions{Algorithm: algorithm})
+	}
+	nrs := NewRedisStorage(redisClient, bucketExpire)
+	nrs.Algorithm = algorithm
+	// NOTE: Reset data
+	nrs.Client.FlushDB()
+	return nrs
+}
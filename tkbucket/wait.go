@@ -0,0 +1,51 @@
+package tkbucket
+
+import (
+	"context"
+	"time"
+)
+
+// waitContext is the shared implementation of Bucket.WaitContext.
+func waitContext(ctx context.Context, b Bucket, count int64) error {
+	// Don't touch the bucket if the ctx is already done.
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	now := time.Now()
+	maxWait := infinityDuration
+	if deadline, ok := ctx.Deadline(); ok {
+		maxWait = deadline.Sub(now)
+	}
+	r := reserve(b, now, count, maxWait)
+	if !r.OK() {
+		return r.Err()
+	}
+	d := r.DelayFrom(now)
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		// The tokens are not consumed yet, give them back
+		// so that other waiters can use them.
+		r.Cancel()
+		return ctx.Err()
+	}
+}
+
+// waitMaxDuration is the shared implementation of Bucket.WaitMaxDuration.
+func waitMaxDuration(b Bucket, count int64, maxWait time.Duration) bool {
+	d, ok := b.tryAcquire(time.Now(), count, maxWait)
+	if d > 0 {
+		time.Sleep(d)
+	}
+	return ok
+}
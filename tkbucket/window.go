@@ -0,0 +1,643 @@
+package tkbucket
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// windowOf returns the rolling window of the sliding window buckets,
+// the time a token bucket with the same parameters takes to refill.
+// It is at least a microsecond, so that the indices of the windows
+// are exact in a Lua number.
+func windowOf(fillInterval time.Duration, capacity, quantum int64) time.Duration {
+	if capacity > int64(infinityDuration/fillInterval) {
+		return infinityDuration / time.Duration(quantum)
+	}
+	if window := time.Duration(capacity) * fillInterval / time.Duration(quantum); window > time.Microsecond {
+		return window
+	}
+	return time.Microsecond
+}
+
+// logEntry holds count tokens taken at time, in unix nanoseconds.
+type logEntry struct {
+	time  int64
+	count int64
+}
+
+// windowLogBucket is a memory bucket counting its tokens with
+// SlidingWindowLog.
+type windowLogBucket struct {
+	mu sync.Mutex
+	// startTime holds the moment when the bucket was created.
+	startTime time.Time
+	// capacity holds the number of tokens allowed in the window.
+	capacity int64
+	// window holds the length of the rolling window in nanoseconds.
+	window int64
+	// log holds the tokens taken in the window, the oldest first.
+	// The tokens reserved by tryAcquire are logged at the time they
+	// are available, which may be in the future.
+	log []logEntry
+	// used holds the sum of the tokens in the log.
+	used int64
+	accessTime
+}
+
+func (b *windowLogBucket) StartTime() time.Time {
+	return b.startTime
+}
+
+func (b *windowLogBucket) Capacity() int64 {
+	return b.capacity
+}
+
+// Acquire takes up to count immediately available tokens from the bucket
+// result > 0，sufficient token
+func (b *windowLogBucket) Acquire(count int64) int64 {
+	return b.acquire(time.Now(), count)
+}
+
+// TryAcquire try to acquire the token from the bucket.
+// It returns infinityDuration if count is greater than the capacity.
+func (b *windowLogBucket) TryAcquire(count int64) time.Duration {
+	d, ok := b.tryAcquire(time.Now(), count, infinityDuration)
+	if !ok {
+		return infinityDuration
+	}
+	return d
+}
+
+// Wait try to acquire the token from the bucket and wait util to get it
+func (b *windowLogBucket) Wait(count int64) {
+	if d, ok := b.tryAcquire(time.Now(), count, infinityDuration); ok && d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// WaitContext try to acquire the token from the bucket and wait util to get it,
+// or until ctx is done.
+func (b *windowLogBucket) WaitContext(ctx context.Context, count int64) error {
+	return waitContext(ctx, b, count)
+}
+
+// WaitMaxDuration try to acquire the token from the bucket and wait util to get it,
+// if it needs to wait for no greater than maxWait.
+func (b *windowLogBucket) WaitMaxDuration(count int64, maxWait time.Duration) bool {
+	return waitMaxDuration(b, count, maxWait)
+}
+
+// Reserve books count tokens from the bucket, see Reservation.
+func (b *windowLogBucket) Reserve(count int64) *Reservation {
+	return reserve(b, time.Now(), count, infinityDuration)
+}
+
+// Available returns the number of available tokens.
+func (b *windowLogBucket) Available() int64 {
+	return b.available(time.Now())
+}
+
+// AcquireE is like Acquire, the windowLogBucket never fails.
+func (b *windowLogBucket) AcquireE(count int64) (int64, error) {
+	return b.acquireE(time.Now(), count)
+}
+
+// TryAcquireE is like TryAcquire, the windowLogBucket never fails.
+func (b *windowLogBucket) TryAcquireE(count int64) (time.Duration, error) {
+	return b.tryAcquireE(time.Now(), count, infinityDuration)
+}
+
+// AvailableE is like Available, the windowLogBucket never fails.
+func (b *windowLogBucket) AvailableE() (int64, error) {
+	return b.availableE(time.Now())
+}
+
+// Allow takes count tokens if they are all available, see Decision.
+func (b *windowLogBucket) Allow(count int64) Decision {
+	return b.allow(time.Now(), count)
+}
+
+// AllowE is like Allow, the windowLogBucket never fails.
+func (b *windowLogBucket) AllowE(count int64) (Decision, error) {
+	return b.allowE(time.Now(), count)
+}
+
+// acquire is the internal version of Acquire - it takes the
+// current time as an argument to enable easy testing.
+func (b *windowLogBucket) acquire(now time.Time, count int64) int64 {
+	b.touch(now)
+	if count <= 0 {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := now.UnixNano()
+	b.prune(t)
+	avail := b.capacity - b.used
+	if avail <= 0 {
+		return 0
+	}
+	if count > avail {
+		count = avail
+	}
+	b.record(t, count)
+	return count
+}
+
+// tryAcquire is the internal version of TryAcquire - it takes the current time as
+// an argument to enable easy testing.
+func (b *windowLogBucket) tryAcquire(now time.Time, count int64, maxWait time.Duration) (time.Duration, bool) {
+	b.touch(now)
+	if count <= 0 {
+		return 0, true
+	}
+	// The tokens never fit in the window.
+	if count > b.capacity {
+		return 0, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := now.UnixNano()
+	b.prune(t)
+	at := b.availableAt(t, count)
+	waitTime := time.Duration(at - t)
+	if waitTime > maxWait {
+		return 0, false
+	}
+	b.record(at, count)
+	return waitTime, true
+}
+
+// available is the internal version of Available - it takes the current time as
+// an argument to enable easy testing.
+func (b *windowLogBucket) available(now time.Time) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.prune(now.UnixNano())
+	return b.capacity - b.used
+}
+
+// allow is the internal version of Allow - it takes the current time as
+// an argument to enable easy testing.
+func (b *windowLogBucket) allow(now time.Time, count int64) Decision {
+	b.touch(now)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := now.UnixNano()
+	b.prune(t)
+	d := Decision{Limit: b.capacity}
+	switch {
+	case count <= maxInt64(b.capacity-b.used, 0):
+		d.Allowed, d.Granted = true, maxInt64(count, 0)
+		if d.Granted > 0 {
+			b.record(t, d.Granted)
+		}
+	case count > b.capacity:
+		// The tokens never fit in the window.
+		d.RetryAfter = infinityDuration
+	default:
+		d.RetryAfter = time.Duration(b.availableAt(t, count) - t)
+	}
+	d.Remaining = maxInt64(b.capacity-b.used, 0)
+	// The bucket is full again when the latest tokens leave the window.
+	if n := len(b.log); n > 0 {
+		d.ResetAfter = time.Duration(b.log[n-1].time + b.window - t)
+	}
+	return d
+}
+
+func (b *windowLogBucket) acquireE(now time.Time, count int64) (int64, error) {
+	return b.acquire(now, count), nil
+}
+
+func (b *windowLogBucket) tryAcquireE(now time.Time, count int64, maxWait time.Duration) (time.Duration, error) {
+	d, ok := b.tryAcquire(now, count, maxWait)
+	if !ok {
+		return 0, ErrWaitTooLong
+	}
+	return d, nil
+}
+
+func (b *windowLogBucket) availableE(now time.Time) (int64, error) {
+	return b.available(now), nil
+}
+
+func (b *windowLogBucket) allowE(now time.Time, count int64) (Decision, error) {
+	return b.allow(now, count), nil
+}
+
+// refund removes count tokens that were reserved by tryAcquire but not
+// consumed yet from the log, from the entry they are logged with at at.
+// The entry closest to at is taken, at may be off with ServerTime.
+func (b *windowLogBucket) refund(now, at time.Time, count int64) error {
+	b.touch(now)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.prune(now.UnixNano())
+	i := closestEntry(b.log, at.UnixNano())
+	if i < 0 || count <= 0 {
+		return nil
+	}
+	if b.log[i].count > count {
+		b.log[i].count -= count
+		b.used -= count
+		return nil
+	}
+	b.used -= b.log[i].count
+	b.log = append(b.log[:i], b.log[i+1:]...)
+	return nil
+}
+
+// closestEntry returns the index of the entry of log logged closest to t,
+// the earliest of two, or -1 if the log is empty.
+func closestEntry(log []logEntry, t int64) int {
+	closest := -1
+	var distance int64
+	for i, e := range log {
+		d := e.time - t
+		if d < 0 {
+			d = -d
+		}
+		if closest < 0 || d < distance {
+			closest, distance = i, d
+		}
+	}
+	return closest
+}
+
+// availableAt returns when count more tokens fit in the window, t or
+// the time enough of the oldest tokens leave it. The log must be pruned.
+func (b *windowLogBucket) availableAt(t, count int64) int64 {
+	need := b.used + count - b.capacity
+	if need <= 0 {
+		return t
+	}
+	// Wait until enough of the oldest tokens leave the window.
+	var freed int64
+	for _, e := range b.log {
+		freed += e.count
+		if freed >= need {
+			return e.time + b.window
+		}
+	}
+	return t
+}
+
+// prune removes the tokens which left the window at t from the log.
+func (b *windowLogBucket) prune(t int64) {
+	i := 0
+	for i < len(b.log) && b.log[i].time <= t-b.window {
+		b.used -= b.log[i].count
+		i++
+	}
+	b.log = b.log[i:]
+}
+
+// record logs count tokens at t. The log stays sorted, the tokens taken
+// before the tokens reserved in the future are inserted before them.
+func (b *windowLogBucket) record(t, count int64) {
+	i := sort.Search(len(b.log), func(i int) bool { return b.log[i].time >= t })
+	switch {
+	case i < len(b.log) && b.log[i].time == t:
+		b.log[i].count += count
+	case i == len(b.log):
+		b.log = append(b.log, logEntry{time: t, count: count})
+	default:
+		b.log = append(b.log, logEntry{})
+		copy(b.log[i+1:], b.log[i:])
+		b.log[i] = logEntry{time: t, count: count}
+	}
+	b.used += count
+}
+
+// windowCounterBucket is a memory bucket counting its tokens with
+// SlidingWindowCounter. The fixed windows are aligned on the unix epoch.
+type windowCounterBucket struct {
+	mu sync.Mutex
+	// startTime holds the moment when the bucket was created.
+	startTime time.Time
+	// capacity holds the number of tokens allowed in the window.
+	capacity int64
+	// window holds the length of the fixed windows in nanoseconds.
+	window int64
+	// counts holds the tokens taken in the fixed windows by index, from the
+	// previous window on. The tokens reserved by tryAcquire are counted in
+	// the window they are available in, which may be in the future.
+	counts map[int64]int64
+	accessTime
+}
+
+func (b *windowCounterBucket) StartTime() time.Time {
+	return b.startTime
+}
+
+func (b *windowCounterBucket) Capacity() int64 {
+	return b.capacity
+}
+
+// Acquire takes up to count immediately available tokens from the bucket
+// result > 0，sufficient token
+func (b *windowCounterBucket) Acquire(count int64) int64 {
+	return b.acquire(time.Now(), count)
+}
+
+// TryAcquire try to acquire the token from the bucket.
+// It returns infinityDuration if count is greater than the capacity.
+func (b *windowCounterBucket) TryAcquire(count int64) time.Duration {
+	d, ok := b.tryAcquire(time.Now(), count, infinityDuration)
+	if !ok {
+		return infinityDuration
+	}
+	return d
+}
+
+// Wait try to acquire the token from the bucket and wait util to get it
+func (b *windowCounterBucket) Wait(count int64) {
+	if d, ok := b.tryAcquire(time.Now(), count, infinityDuration); ok && d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// WaitContext try to acquire the token from the bucket and wait util to get it,
+// or until ctx is done.
+func (b *windowCounterBucket) WaitContext(ctx context.Context, count int64) error {
+	return waitContext(ctx, b, count)
+}
+
+// WaitMaxDuration try to acquire the token from the bucket and wait util to get it,
+// if it needs to wait for no greater than maxWait.
+func (b *windowCounterBucket) WaitMaxDuration(count int64, maxWait time.Duration) bool {
+	return waitMaxDuration(b, count, maxWait)
+}
+
+// Reserve books count tokens from the bucket, see Reservation.
+func (b *windowCounterBucket) Reserve(count int64) *Reservation {
+	return reserve(b, time.Now(), count, infinityDuration)
+}
+
+// Available returns the number of available tokens.
+func (b *windowCounterBucket) Available() int64 {
+	return b.available(time.Now())
+}
+
+// AcquireE is like Acquire, the windowCounterBucket never fails.
+func (b *windowCounterBucket) AcquireE(count int64) (int64, error) {
+	return b.acquireE(time.Now(), count)
+}
+
+// TryAcquireE is like TryAcquire, the windowCounterBucket never fails.
+func (b *windowCounterBucket) TryAcquireE(count int64) (time.Duration, error) {
+	return b.tryAcquireE(time.Now(), count, infinityDuration)
+}
+
+// AvailableE is like Available, the windowCounterBucket never fails.
+func (b *windowCounterBucket) AvailableE() (int64, error) {
+	return b.availableE(time.Now())
+}
+
+// Allow takes count tokens if they are all available, see Decision.
+func (b *windowCounterBucket) Allow(count int64) Decision {
+	return b.allow(time.Now(), count)
+}
+
+// AllowE is like Allow, the windowCounterBucket never fails.
+func (b *windowCounterBucket) AllowE(count int64) (Decision, error) {
+	return b.allowE(time.Now(), count)
+}
+
+// acquire is the internal version of Acquire - it takes the
+// current time as an argument to enable easy testing.
+func (b *windowCounterBucket) acquire(now time.Time, count int64) int64 {
+	b.touch(now)
+	if count <= 0 {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	idx, elapsed := b.split(now)
+	b.prune(idx)
+	avail := b.avail(idx, elapsed)
+	if avail <= 0 {
+		return 0
+	}
+	if count > avail {
+		count = avail
+	}
+	b.counts[idx] += count
+	return count
+}
+
+// tryAcquire is the internal version of TryAcquire - it takes the current time as
+// an argument to enable easy testing.
+func (b *windowCounterBucket) tryAcquire(now time.Time, count int64, maxWait time.Duration) (time.Duration, bool) {
+	b.touch(now)
+	if count <= 0 {
+		return 0, true
+	}
+	// The tokens never fit in the window.
+	if count > b.capacity {
+		return 0, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	idx, elapsed := b.split(now)
+	b.prune(idx)
+	w, waitTime := b.find(idx, elapsed, count)
+	if waitTime > maxWait {
+		return 0, false
+	}
+	b.counts[w] += count
+	return waitTime, true
+}
+
+// available is the internal version of Available - it takes the current time as
+// an argument to enable easy testing.
+func (b *windowCounterBucket) available(now time.Time) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	idx, elapsed := b.split(now)
+	b.prune(idx)
+	return b.avail(idx, elapsed)
+}
+
+// allow is the internal version of Allow - it takes the current time as
+// an argument to enable easy testing.
+func (b *windowCounterBucket) allow(now time.Time, count int64) Decision {
+	b.touch(now)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	idx, elapsed := b.split(now)
+	b.prune(idx)
+	avail := b.avail(idx, elapsed)
+	d := Decision{Limit: b.capacity}
+	switch {
+	case count <= maxInt64(avail, 0):
+		d.Allowed, d.Granted = true, maxInt64(count, 0)
+		if d.Granted > 0 {
+			b.counts[idx] += d.Granted
+			avail -= d.Granted
+		}
+	case count > b.capacity:
+		// The tokens never fit in the window.
+		d.RetryAfter = infinityDuration
+	default:
+		_, d.RetryAfter = b.find(idx, elapsed, count)
+	}
+	d.Remaining = maxInt64(avail, 0)
+	// The bucket is full again when the latest window holding tokens
+	// is not the previous one anymore.
+	latest := idx - 2
+	for w, n := range b.counts {
+		if n > 0 && w > latest {
+			latest = w
+		}
+	}
+	if latest >= idx-1 {
+		d.ResetAfter = time.Duration((latest+2-idx)*b.window - elapsed)
+	}
+	return d
+}
+
+func (b *windowCounterBucket) acquireE(now time.Time, count int64) (int64, error) {
+	return b.acquire(now, count), nil
+}
+
+func (b *windowCounterBucket) tryAcquireE(now time.Time, count int64, maxWait time.Duration) (time.Duration, error) {
+	d, ok := b.tryAcquire(now, count, maxWait)
+	if !ok {
+		return 0, ErrWaitTooLong
+	}
+	return d, nil
+}
+
+func (b *windowCounterBucket) availableE(now time.Time) (int64, error) {
+	return b.available(now), nil
+}
+
+func (b *windowCounterBucket) allowE(now time.Time, count int64) (Decision, error) {
+	return b.allow(now, count), nil
+}
+
+// refund removes count tokens that were reserved by tryAcquire but not
+// consumed yet from the counters, the latest window first.
+func (b *windowCounterBucket) refund(now, at time.Time, count int64) error {
+	b.touch(now)
+	if count <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	idx, _ := b.split(now)
+	b.prune(idx)
+	// The reserved tokens are counted in the window they are available in.
+	w, _ := b.split(at)
+	n := b.counts[w]
+	if n > count {
+		n = count
+	}
+	if n > 0 {
+		b.counts[w] -= n
+	}
+	return nil
+}
+
+// split returns the index of the fixed window of now
+// and the time elapsed in it.
+func (b *windowCounterBucket) split(now time.Time) (int64, int64) {
+	t := now.UnixNano()
+	return t / b.window, t % b.window
+}
+
+// find returns the first window from idx where count more tokens fit, and
+// how long to wait for them from elapsed in the window idx. There is always
+// one after the windows holding reserved tokens. count must not exceed the
+// capacity.
+func (b *windowCounterBucket) find(idx, elapsed, count int64) (int64, time.Duration) {
+	for w := idx; ; w++ {
+		room := b.capacity - b.counts[w] - count
+		if room < 0 {
+			continue
+		}
+		// start holds the time elapsed in the window w when the weight
+		// of the previous window is low enough.
+		var start int64
+		if prev := b.counts[w-1]; prev > 0 {
+			start = int64(math.Ceil(float64(b.window) - float64(room)*float64(b.window)/float64(prev)))
+			if start >= b.window {
+				continue
+			}
+		}
+		if w == idx && start < elapsed {
+			start = elapsed
+		}
+		return w, time.Duration((w-idx)*b.window + start - elapsed)
+	}
+}
+
+// prune forgets the windows before the previous one of idx.
+func (b *windowCounterBucket) prune(idx int64) {
+	for w := range b.counts {
+		if w < idx-1 {
+			delete(b.counts, w)
+		}
+	}
+}
+
+// avail returns the number of available tokens at elapsed in the window idx.
+func (b *windowCounterBucket) avail(idx, elapsed int64) int64 {
+	weighted := float64(b.counts[idx-1]) * float64(b.window-elapsed) / float64(b.window)
+	return int64(math.Floor(float64(b.capacity-b.counts[idx]) - weighted))
+}
+
+func createWindowLog(name string, fillInterval time.Duration, capacity, quantum int64) *windowLogBucket {
+	if fillInterval <= 0 {
+		panic("token bucket fill interval is not > 0")
+	}
+	if capacity <= 0 {
+		panic("token bucket capacity is not > 0")
+	}
+	if quantum <= 0 {
+		panic("token bucket quantum is not > 0")
+	}
+	return &windowLogBucket{
+		startTime: time.Now(),
+		capacity:  capacity,
+		window:    int64(windowOf(fillInterval, capacity, quantum)),
+	}
+}
+
+func createWindowCounter(name string, fillInterval time.Duration, capacity, quantum int64) *windowCounterBucket {
+	if fillInterval <= 0 {
+		panic("token bucket fill interval is not > 0")
+	}
+	if capacity <= 0 {
+		panic("token bucket capacity is not > 0")
+	}
+	if quantum <= 0 {
+		panic("token bucket quantum is not > 0")
+	}
+	return &windowCounterBucket{
+		startTime: time.Now(),
+		capacity:  capacity,
+		window:    int64(windowOf(fillInterval, capacity, quantum)),
+		counts:    make(map[int64]int64),
+	}
+}
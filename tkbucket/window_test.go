@@ -0,0 +1,142 @@
+package tkbucket
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//------------------------------------Sliding Window Log Test------------------------------------------
+func TestWindowLog(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, kind := range storageKinds {
+		// 10 tokens in any rolling second.
+		tb, err := newStorage(kind, SlidingWindowLog).Create("msf_window_log", 100*time.Millisecond, 10)
+		asserts.Nil(err, "Token bucket create failed")
+
+		start := tb.StartTime()
+		asserts.Equal(int64(6), tb.acquire(start, 6), kind)
+		asserts.Equal(int64(4), tb.acquire(start.Add(300*time.Millisecond), 5), kind)
+		asserts.Equal(int64(0), tb.acquire(start.Add(500*time.Millisecond), 1), kind)
+		asserts.Equal(int64(0), tb.available(start.Add(999*time.Millisecond)), kind)
+		asserts.Equal(int64(6), tb.available(start.Add(time.Second)), kind)
+
+		// The tokens taken at 300ms must leave the window first.
+		d, ok := tb.tryAcquire(start.Add(time.Second), 8, infinityDuration)
+		asserts.True(ok, kind)
+		asserts.Equal(300*time.Millisecond, d, kind)
+		asserts.Equal(int64(-2), tb.available(start.Add(time.Second)), kind)
+		_, ok = tb.tryAcquire(start.Add(time.Second), 1, 200*time.Millisecond)
+		asserts.False(ok, kind)
+		_, ok = tb.tryAcquire(start.Add(time.Second), 11, infinityDuration)
+		asserts.False(ok, "the tokens never fit in the window")
+
+		asserts.Nil(tb.refund(start.Add(time.Second), start.Add(1300*time.Millisecond), 8), kind)
+		asserts.Equal(int64(6), tb.available(start.Add(time.Second)), kind)
+		asserts.Equal(int64(10), tb.available(start.Add(1300*time.Millisecond)), kind)
+		fmt.Println("WindowLogTest:", kind, "-> success")
+	}
+}
+
+func TestWindowLogRefund(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, kind := range storageKinds {
+		// 10 tokens in any rolling second.
+		tb, err := newStorage(kind, SlidingWindowLog).Create("msf_window_log", 100*time.Millisecond, 10)
+		asserts.Nil(err, "Token bucket create failed")
+
+		// The log counts microseconds in Redis.
+		start := tb.StartTime().Truncate(time.Microsecond)
+		asserts.Equal(int64(5), tb.acquire(start, 5), kind)
+		asserts.Equal(int64(5), tb.acquire(start.Add(500*time.Millisecond), 5), kind)
+		now := start.Add(500 * time.Millisecond)
+		d1, ok := tb.tryAcquire(now, 5, infinityDuration)
+		asserts.True(ok, kind)
+		asserts.Equal(500*time.Millisecond, d1, kind)
+		d2, ok := tb.tryAcquire(now, 5, infinityDuration)
+		asserts.True(ok, kind)
+		asserts.Equal(time.Second, d2, kind)
+
+		// Canceling the first reservation removes its own tokens,
+		// the tokens of the second one stay in the window.
+		asserts.Nil(tb.refund(start.Add(600*time.Millisecond), now.Add(d1), 5), kind)
+		asserts.Equal(int64(5), tb.available(start.Add(2100*time.Millisecond)), kind)
+		asserts.Equal(int64(10), tb.available(start.Add(2500*time.Millisecond)), kind)
+
+		// The tokens taken before a reservation leave the window first.
+		asserts.Equal(int64(5), tb.acquire(start.Add(2500*time.Millisecond), 5), kind)
+		d, ok := tb.tryAcquire(start.Add(2500*time.Millisecond), 5, infinityDuration)
+		asserts.True(ok, kind)
+		asserts.Equal(time.Duration(0), d, kind)
+		d, ok = tb.tryAcquire(start.Add(2500*time.Millisecond), 5, infinityDuration)
+		asserts.True(ok, kind)
+		asserts.Equal(time.Second, d, kind)
+		fmt.Println("WindowLogRefundTest:", kind, "-> success")
+	}
+}
+
+//------------------------------------Sliding Window Counter Test------------------------------------------
+func TestWindowCounter(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, kind := range storageKinds {
+		// 10 tokens in any rolling second.
+		tb, err := newStorage(kind, SlidingWindowCounter).Create("msf_window_counter", 100*time.Millisecond, 10)
+		asserts.Nil(err, "Token bucket create failed")
+
+		// The fixed windows are aligned on the unix epoch.
+		start := tb.StartTime().Truncate(time.Second)
+		asserts.Equal(int64(10), tb.acquire(start, 10), kind)
+		asserts.Equal(int64(0), tb.acquire(start.Add(999*time.Millisecond), 1), kind)
+		asserts.Equal(int64(0), tb.available(start.Add(time.Second)), kind)
+
+		// Half of the previous window overlaps the rolling window.
+		asserts.Equal(int64(5), tb.available(start.Add(1500*time.Millisecond)), kind)
+		asserts.Equal(int64(3), tb.acquire(start.Add(1500*time.Millisecond), 3), kind)
+		asserts.Equal(int64(2), tb.available(start.Add(1500*time.Millisecond)), kind)
+
+		d, ok := tb.tryAcquire(start.Add(1500*time.Millisecond), 4, infinityDuration)
+		asserts.True(ok, kind)
+		asserts.Equal(200*time.Millisecond, d, kind)
+		// The tokens only fit in the next window.
+		d, ok = tb.tryAcquire(start.Add(1500*time.Millisecond), 5, infinityDuration)
+		asserts.True(ok, kind)
+		asserts.Equal(785714286*time.Nanosecond, d, kind)
+		_, ok = tb.tryAcquire(start.Add(1500*time.Millisecond), 1, 100*time.Millisecond)
+		asserts.False(ok, kind)
+		_, ok = tb.tryAcquire(start.Add(1500*time.Millisecond), 11, infinityDuration)
+		asserts.False(ok, "the tokens never fit in the window")
+
+		// The tokens are refunded to the window they were reserved in.
+		asserts.Nil(tb.refund(start.Add(1500*time.Millisecond), start.Add(1700*time.Millisecond), 4), kind)
+		asserts.Equal(int64(2), tb.available(start.Add(1500*time.Millisecond)), kind)
+		asserts.Nil(tb.refund(start.Add(1500*time.Millisecond), start.Add(1500*time.Millisecond+785714286), 5), kind)
+		asserts.Equal(int64(2), tb.available(start.Add(1500*time.Millisecond)), kind)
+		asserts.Equal(int64(7), tb.available(start.Add(2*time.Second)), kind)
+		// Nothing is left to refund in the window.
+		asserts.Nil(tb.refund(start.Add(1500*time.Millisecond), start.Add(2*time.Second), 5), kind)
+		asserts.Equal(int64(7), tb.available(start.Add(2*time.Second)), kind)
+		fmt.Println("WindowCounterTest:", kind, "-> success")
+	}
+}
+
+func TestWindowRedisExpire(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, algorithm := range []Algorithm{SlidingWindowLog, SlidingWindowCounter} {
+		nrs := newStorage("redis", algorithm).(*RedisStorage)
+		tb, err := nrs.Create("msf_window_bucket", 100*time.Millisecond, 10)
+		asserts.Nil(err, "Token bucket create failed")
+		asserts.Equal(int64(0), nrs.Client.Exists("msf_window_bucket").Val(), "nothing is stored before use")
+
+		// The key lives until the tokens leave the window.
+		asserts.Equal(int64(1), tb.Acquire(1))
+		ttl := nrs.Client.PTTL("msf_window_bucket").Val()
+		asserts.True(ttl > 0 && ttl <= 2*time.Second, fmt.Sprintf("%v got ttl %v", algorithm, ttl))
+		fmt.Println("WindowRedisExpireTest:", algorithm, "-> success")
+	}
+}